@@ -15,10 +15,10 @@
 package cmd
 
 import (
-	"fmt"
+	"os"
 
 	"github.com/aroq/uniconf/uniconf"
-	"github.com/aroq/uniconf/unitool"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -33,53 +33,64 @@ var contextCmd = &cobra.Command{
 	Short: "Set context",
 	Long:  `Set context.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var context interface{}
+		// Declared phases can refer context flags as ${env("UNICONF_CONTEXT_NAME")} & ${env("UNICONF_CONTEXT_ID")}.
+		os.Setenv("UNICONF_CONTEXT_NAME", viper.GetString("context_name"))
+		os.Setenv("UNICONF_CONTEXT_ID", viper.GetString("context_id"))
 
-		uniconf.AddPhase(&uniconf.Phase{
-			Name: "config",
-			Phases: []*uniconf.Phase{
-				{
-					Name:     "load",
-					Callback: uniconf.Load,
-				},
-				{
-					Name:     "flatten_config",
-					Callback: uniconf.FlattenConfig,
-				},
-				{
-					Name:     "process",
-					Callback: uniconf.ProcessKeys,
-					Args: []interface{}{
-						"jobs",
-						"",
-						[]*uniconf.Processor{
-							{
-								Callback:    uniconf.FromProcess,
-								IncludeKeys: []string{uniconf.IncludeListElementName},
-							},
+		declared, err := uniconf.LoadPhases("context")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !declared {
+			addDefaultContextPhases()
+		}
+
+		err = uniconf.Execute()
+		writeTrace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifyLockfile()
+		printOutput()
+	},
+}
+
+// addDefaultContextPhases adds phases used if config doesn't declare any.
+func addDefaultContextPhases() {
+	var context interface{}
+
+	uniconf.AddPhase(&uniconf.Phase{
+		Name: "config",
+		Phases: []*uniconf.Phase{
+			{
+				Name:     "load",
+				Callback: uniconf.Load,
+			},
+			{
+				Name:     "process",
+				Callback: uniconf.ProcessKeys,
+				Args: []interface{}{
+					"jobs",
+					"",
+					[]*uniconf.Processor{
+						{
+							Callback:    uniconf.FromProcess,
+							IncludeKeys: []string{uniconf.IncludeListElementName},
 						},
 					},
 				},
-				{
-					Name:     "process_context",
-					Callback: uniconf.ProcessContext,
-					Args: []interface{}{
-						viper.Get("context_name"),
-						viper.Get("context_id"),
-					},
-					Result: &context,
+			},
+			{
+				Name:     "process_context",
+				Callback: uniconf.ProcessContext,
+				Args: []interface{}{
+					viper.Get("context_name"),
+					viper.Get("context_id"),
 				},
+				Result: &context,
 			},
-		})
-
-		uniconf.Execute()
-		if outputFormat == "yaml" {
-			fmt.Println(unitool.MarshallYaml(uniconf.Config()))
-		}
-		if outputFormat == "json" {
-			fmt.Println(unitool.MarshallJSON(uniconf.Config()))
-		}
-	},
+		},
+	})
 }
 
 func init() {
@@ -0,0 +1,62 @@
+// Copyright © 2018 Alexander Tolstikov <tolstikov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aroq/uniconf/uniconf"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// explainCmd represents the explain command
+var explainCmd = &cobra.Command{
+	Use:   "explain <key.path>",
+	Short: "Show where config values come from",
+	Long: `Load configuration and print each value under the key path with
+the source, entity, file & position it was defined in, followed by
+all entities which overrode it in order.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		declared, err := uniconf.LoadPhases("default")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !declared {
+			addDefaultPhases()
+		}
+		err = uniconf.Execute()
+		writeTrace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		path := ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		provenance, err := uniconf.Explain(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range provenance {
+			fmt.Println(p)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+}
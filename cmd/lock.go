@@ -0,0 +1,51 @@
+// Copyright © 2017 Alexander Tolstikov <tolstikov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/aroq/uniconf/uniconf"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Update lockfile",
+	Long: `Execute configured phases fetching all sources again and write
+resolved commits & checksums of sources to the lockfile.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		uniconf.SetCacheOptions(uniconf.CacheOptions{Offline: offline, Refresh: !offline})
+		declared, err := uniconf.LoadPhases("default")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !declared {
+			addDefaultPhases()
+		}
+		err = uniconf.Execute()
+		writeTrace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := uniconf.WriteLockfile([]interface{}{lockfile}); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+}
@@ -19,8 +19,10 @@ import (
 
 	"fmt"
 	"path"
+	"strings"
 
 	"github.com/aroq/uniconf/uniconf"
+	"github.com/aroq/uniconf/unitool"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -31,6 +33,28 @@ var cfgEnvVar string
 
 var outputFormat string
 
+var traceFile string
+
+var traceFormat string
+
+var tracer *uniconf.Tracer
+
+var offline bool
+
+var refresh bool
+
+var lockfile string
+
+var locked bool
+
+var listMerge []string
+
+var encodeOptions unitool.EncodeOptions
+
+var revealSecrets bool
+
+var undefinedMode string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "uniconf",
@@ -42,48 +66,64 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		uniconf.AddPhase(&uniconf.Phase{
-			Name: "config",
-			Phases: []*uniconf.Phase{
-				{
-					Name:     "load",
-					Callback: uniconf.Load,
-				},
-				{
-					Name:     "flatten_config",
-					Callback: uniconf.FlattenConfig,
-				},
+		declared, err := uniconf.LoadPhases("default")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !declared {
+			addDefaultPhases()
+		}
+
+		err = uniconf.Execute()
+		writeTrace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifyLockfile()
+		printOutput()
+	},
+}
+
+// printOutput prints config in the requested output format.
+func printOutput() {
+	output, err := uniconf.Output(outputFormat, encodeOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(output)
+}
+
+// addDefaultPhases adds phases used if config doesn't declare any.
+func addDefaultPhases() {
+	uniconf.AddPhase(&uniconf.Phase{
+		Name: "config",
+		Phases: []*uniconf.Phase{
+			{
+				Name:     "load",
+				Callback: uniconf.Load,
 			},
-		})
-
-		uniconf.AddPhase(&uniconf.Phase{
-			Name: "process",
-			Phases: []*uniconf.Phase{
-				{
-					Name:     "process",
-					Callback: uniconf.ProcessKeys,
-					Args: []interface{}{
-						"",
-						"",
-						[]*uniconf.Processor{
-							{
-								Callback:    uniconf.FromProcess,
-								IncludeKeys: []string{uniconf.IncludeListElementName},
-							},
+		},
+	})
+
+	uniconf.AddPhase(&uniconf.Phase{
+		Name: "process",
+		Phases: []*uniconf.Phase{
+			{
+				Name:     "process",
+				Callback: uniconf.ProcessKeys,
+				Args: []interface{}{
+					"",
+					"",
+					[]*uniconf.Processor{
+						{
+							Callback:    uniconf.FromProcess,
+							IncludeKeys: []string{uniconf.IncludeListElementName},
 						},
 					},
 				},
 			},
-		})
-
-		uniconf.Execute()
-		if outputFormat == "yaml" {
-			fmt.Println(uniconf.GetYAML())
-		}
-		if outputFormat == "json" {
-			fmt.Println(uniconf.GetJSON())
-		}
-	},
+		},
+	})
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -101,17 +141,89 @@ func init() {
 	// Global persistent flags.
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config file", "c", path.Join(".unipipe/config.yaml"), "config file ('.unipipe/config.yaml' by default)")
 	rootCmd.PersistentFlags().StringVarP(&cfgEnvVar, "config env var", "e", "UNICONF", "config ENV VAR name ('UNICONF' by default)")
-	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "yaml", "output format, e.g. 'yaml' or 'json' ('yaml' by default)")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "yaml", "output format: "+strings.Join(unitool.Encoders(), ", ")+" ('yaml' by default)")
+	rootCmd.PersistentFlags().StringVar(&encodeOptions.Separator, "key-separator", "", "separator of nested keys in flat output formats, e.g. '_' ('_' for dotenv & shell, '.' for properties by default)")
+	rootCmd.PersistentFlags().StringVar(&encodeOptions.KeyCase, "key-case", "", "case of keys in flat output formats: 'upper', 'lower' or 'preserve'")
+	rootCmd.PersistentFlags().StringVar(&encodeOptions.Prefix, "key-prefix", "", "prefix of keys in flat output formats")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace", "", "file to write phases execution trace to")
+	rootCmd.PersistentFlags().StringVar(&traceFormat, "trace-format", "json", "trace format, e.g. 'json' or 'chrome' ('json' by default)")
+	rootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "use only cached sources")
+	rootCmd.PersistentFlags().BoolVar(&refresh, "refresh", false, "fetch sources even if cached copies are fresh")
+	rootCmd.PersistentFlags().StringVar(&lockfile, "lockfile", uniconf.LockfileName, "lockfile name ('uniconf.lock' by default)")
+	rootCmd.PersistentFlags().BoolVar(&locked, "locked", false, "fail if sources are resolved differently than in the lockfile")
+	rootCmd.PersistentFlags().BoolVar(&revealSecrets, "reveal-secrets", false, "print resolved secrets instead of redacting them")
+	rootCmd.PersistentFlags().StringVar(&undefinedMode, "undefined", uniconf.UndefinedStrict, "mode of undefined references in interpolations: 'strict', 'keep' or 'empty' ('strict' by default)")
+	rootCmd.PersistentFlags().StringArrayVar(&listMerge, "list-merge", nil, "list merge strategy, e.g. 'unique' or 'jobs.*.webhooks=merge-by-key:name' for the key path")
 }
 
 // initConfig initializes Uniconf.
 func initConfig() {
+	if offline && refresh {
+		log.Fatal("--offline and --refresh flags can't be used together")
+	}
+	if err := unitool.CheckEncoding(outputFormat, encodeOptions); err != nil {
+		log.Fatal(err)
+	}
+	uniconf.SetCacheOptions(uniconf.CacheOptions{Offline: offline, Refresh: refresh})
+	uniconf.SetRevealSecrets(revealSecrets)
+	if err := uniconf.SetUndefinedMode(undefinedMode); err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range listMerge {
+		path, s := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			path, s = v[:i], v[i+1:]
+		}
+		strategy, err := unitool.ParseListStrategy(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uniconf.SetListMergeStrategy(path, strategy)
+	}
+
 	uniconf.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
 		"configMap": map[string]interface{}{
 			"root": defaultUniconfConfig(),
 		},
 	}))
-	uniconf.SetRootSource("root")
+	if err := uniconf.SetRootSource("root"); err != nil {
+		log.Fatal(err)
+	}
+	if traceFile != "" {
+		tracer = uniconf.Trace()
+	}
+}
+
+// verifyLockfile checks loaded sources against the lockfile in locked mode.
+func verifyLockfile() {
+	if !locked {
+		return
+	}
+	if _, err := uniconf.VerifyLockfile([]interface{}{lockfile}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeTrace writes phases execution trace if it was requested.
+func writeTrace() {
+	if tracer == nil {
+		return
+	}
+	f, err := os.Create(traceFile)
+	if err != nil {
+		log.Errorf("trace was not written: %v", err)
+		return
+	}
+	defer f.Close()
+	switch traceFormat {
+	case "chrome":
+		err = tracer.WriteChromeTrace(f)
+	default:
+		err = tracer.WriteJSON(f)
+	}
+	if err != nil {
+		log.Errorf("trace was not written: %v", err)
+	}
 }
 
 // defaultUniconfConfig provides default Uniconf configuration.
@@ -0,0 +1,67 @@
+// Copyright © 2018 Alexander Tolstikov <tolstikov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aroq/uniconf/uniconf"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate [schema key...]",
+	Short: "Validate config against JSON Schemas",
+	Long: `Load configuration and validate it against JSON Schemas declared
+in the "schemas" key, e.g. "schemas: {jobs.*: ./schemas/job.json}".
+Only schemas of given keys are used if any are passed. Errors are
+printed to stderr, schema keys matching no config values are errors.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		declared, err := uniconf.LoadPhases("default")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !declared {
+			addDefaultPhases()
+		}
+		err = uniconf.Execute()
+		writeTrace()
+		if err != nil {
+			log.Fatal(err)
+		}
+		inputs := make([]interface{}, len(args))
+		for i, arg := range args {
+			inputs[i] = arg
+		}
+		if _, err := uniconf.Validate(inputs); err != nil {
+			if errs, ok := err.(uniconf.Errors); ok {
+				for _, e := range errs {
+					fmt.Fprintln(os.Stderr, e)
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -2,20 +2,58 @@ package uniconf
 
 import (
 	"github.com/aroq/uniconf/unitool"
+	log "github.com/sirupsen/logrus"
 )
 
-func Collect(jsonPath, key string) string { return u.collect(jsonPath, key) }
-func (u *Uniconf) collect(jsonPath, key string) string {
-	result, _ := unitool.DeepCollectParams(u.config, jsonPath, key)
+func Collect(jsonPath, key string) string { return u.Collect(jsonPath, key) }
+
+// Collect returns params collected by the path as YAML.
+func (u *Uniconf) Collect(jsonPath, key string) string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.outputConfig()
+	if err != nil {
+		log.Errorf("Collect error: %v", err)
+		return ""
+	}
+	result, _ := unitool.DeepCollectParams(config, jsonPath, key)
 	return unitool.MarshallYaml(result)
 }
 
-func GetYAML() (yamlString string) { return u.getYAML() }
-func (u *Uniconf) getYAML() string {
-	return unitool.MarshallYaml(u.config)
+func GetYAML() (yamlString string) { return u.GetYAML() }
+
+// GetYAML returns config as YAML.
+func (u *Uniconf) GetYAML() string {
+	return u.output("yaml")
+}
+
+func GetJSON() (yamlString string) { return u.GetJSON() }
+
+// GetJSON returns config as JSON.
+func (u *Uniconf) GetJSON() string {
+	return u.output("json")
+}
+
+func (u *Uniconf) output(format string) string {
+	s, err := u.Output(format, unitool.EncodeOptions{})
+	if err != nil {
+		log.Errorf("%s output error: %v", format, err)
+	}
+	return s
+}
+
+func Output(format string, options unitool.EncodeOptions) (string, error) {
+	return u.Output(format, options)
 }
 
-func GetJSON() (yamlString string) { return u.getJSON() }
-func (u *Uniconf) getJSON() string {
-	return unitool.MarshallJSON(u.config)
+// Output returns config encoded in the output format, see unitool.Encoders.
+func (u *Uniconf) Output(format string, options unitool.EncodeOptions) (string, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.outputConfig()
+	if err != nil {
+		return "", err
+	}
+	stream, err := unitool.Encode(format, config, options)
+	return string(stream), err
 }
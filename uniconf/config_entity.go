@@ -2,6 +2,7 @@ package uniconf
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/aroq/uniconf/unitool"
@@ -14,6 +15,8 @@ type ConfigEntity struct {
 	parent *ConfigEntity
 	config map[string]interface{}
 	source SourceHandler
+	// origins holds origins of leaf values of the config.
+	origins unitool.Origins
 }
 
 func NewConfigEntity(s *Source, configMap map[string]interface{}) (*ConfigEntity, error) {
@@ -22,10 +25,11 @@ func NewConfigEntity(s *Source, configMap map[string]interface{}) (*ConfigEntity
 			stream := configMap["stream"].([]byte)
 			if stream != nil {
 				// TODO: check it.
-				conf, err := unitool.UnmarshalByType(configMap["format"].(string), stream)
-				if err == nil {
-					configMap["config"] = conf
+				conf, positions, err := unitool.UnmarshalWithPositions(configMap["format"].(string), stream)
+				if err != nil {
+					return nil, err
 				}
+				configMap["config"], configMap["positions"] = conf, positions
 			}
 		}
 	}
@@ -49,47 +53,37 @@ func NewConfigEntity(s *Source, configMap map[string]interface{}) (*ConfigEntity
 		config: configMap["config"].(map[string]interface{}),
 		parent: parent,
 	}
+	origin := unitool.Origin{Source: s.name, EntityID: c.id}
+	origin.File, _ = configMap["file"].(string)
+	positions, _ := configMap["positions"].(map[string]unitool.Position)
+	c.origins = unitool.NewOrigins(c.config, origin, positions)
 	return c, nil
 }
 
-func (c *ConfigEntity) process() {
+func (c *ConfigEntity) process() error {
 	if len(c.config) != 0 {
-		c.processSources()
-		c.processIncludes()
+		if err := c.processSources(); err != nil {
+			return err
+		}
+		return c.processIncludes()
 	}
+	return nil
 }
 
-func (c *ConfigEntity) processSources() {
+// processSources registers sources declared by the entity & loads them concurrently before includes are processed.
+func (c *ConfigEntity) processSources() error {
+	u := c.source.Uniconf()
+	declared := make([]SourceHandler, 0)
 	if sources, ok := c.config[sourceMapElementName].(map[string]interface{}); ok {
 		for k, v := range sources {
 			log.Printf("Process source: %s", k)
 			if _, ok := u.sources[k]; !ok {
-				// TODO: Check source type here.
-				sourceType := "repo"
-				switch v.(type) {
-				case string:
-					sourceType = "go-getter"
-				case map[string]interface{}:
-					if t, ok := v.(map[string]interface{})["type"]; ok {
-						sourceType = t.(string)
-					}
-				}
-				var source SourceHandler
-				switch sourceType {
-				case "go-getter":
-					source = NewSourceGoGetter(k, v.(string))
-				case "repo":
-					source = NewSourceRepo(k, v.(map[string]interface{}))
-				case "env":
-					source = NewSourceEnv(k, v.(map[string]interface{}))
-				case "file":
-					source = NewSourceFile(k, v.(map[string]interface{}))
-				case "config_map":
-					source = NewSourceConfigMap(k, v.(map[string]interface{}))
-				default:
-					source = NewSourceRepo(k, v.(map[string]interface{}))
+				source, err := newSourceFromSpec(k, v)
+				if err != nil {
+					return &Error{Path: sourceMapElementName + "." + k, Err: err}
 				}
-				u.sources[k] = source
+				u.addSource(source)
+				declared = append(declared, source)
 
 				if autoloadID := source.Autoload(); autoloadID != "" {
 					if _, ok := c.config[IncludeListElementName]; !ok {
@@ -102,9 +96,43 @@ func (c *ConfigEntity) processSources() {
 			}
 		}
 	}
+	switch errs := u.loadSources(declared); len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// label returns the entity name used in include chains, e.g. "drupipe:helm".
+func (c *ConfigEntity) label() string {
+	if c.parent == nil {
+		return c.title
+	}
+	return c.source.Name() + ":" + c.title
+}
+
+// includeChain returns labels of entities from the root to the entity if the entity
+// with given id is its ancestor (or the entity itself), i.e. including it would form a cycle.
+func (c *ConfigEntity) includeChain(sourceName, id string) []string {
+	cycle := false
+	chain := make([]string, 0)
+	for e := c; e != nil; e = e.parent {
+		chain = append([]string{e.label()}, chain...)
+		if e.source.Name() == sourceName && e.id == id {
+			cycle = true
+		}
+	}
+	if !cycle {
+		return nil
+	}
+	return chain
 }
 
-func (c *ConfigEntity) processIncludes() {
+func (c *ConfigEntity) processIncludes() error {
+	u := c.source.Uniconf()
 	parseScenario := func(scenario string) (sourceName, scenarioName string) {
 		sourceName, include := "", ""
 		if strings.Contains(scenario, ":") {
@@ -117,28 +145,67 @@ func (c *ConfigEntity) processIncludes() {
 	}
 
 	includesConfig := make(map[string]interface{})
+	includesOrigins := make(unitool.Origins)
+	mergeOptions := u.getMergeOptions()
 
 	if includes, ok := c.config[IncludeListElementName]; ok {
 		for _, v := range includes.([]interface{}) {
-			sourceName, scenarioID := parseScenario(v.(string))
+			// Includes are either "source:id" strings or maps like {id: "source:id", format: ini}.
+			include, format := "", ""
+			switch v := v.(type) {
+			case string:
+				include = v
+			case map[string]interface{}:
+				include, _ = v["id"].(string)
+				format, _ = v["format"].(string)
+			}
+			if include == "" {
+				return &Error{Path: IncludeListElementName, Err: fmt.Errorf("invalid include: %v", v)}
+			}
+			sourceName, scenarioID := parseScenario(include)
 			// TODO: check if title is needed.
 			title := scenarioID
-			source := u.getSource(sourceName)
-			ids, _ := source.GetIncludeConfigEntityIds(scenarioID)
+			source, err := u.getSource(sourceName)
+			if err != nil {
+				return err
+			}
+			ids, err := source.GetIncludeConfigEntityIds(scenarioID)
+			if err != nil {
+				return &Error{Source: sourceName, EntityID: scenarioID, Err: err}
+			}
+			// Preceding ids are hierarchy parents of the included entity, e.g. "helm" for "helm/jobs",
+			// they are skipped as already loaded if they are ancestors.
+			if len(ids) > 0 {
+				id := ids[len(ids)-1]
+				if chain := c.includeChain(source.Name(), id); chain != nil {
+					return &Error{Source: sourceName, EntityID: id, Err: fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), sourceName+":"+scenarioID)}
+				}
+			}
 			for _, id := range ids {
 				log.Printf("Process include: %s", source.Path()+":"+id)
-				if subConfigEntity, err := source.LoadConfigEntity(map[string]interface{}{"id": id, "title": title, "parent": c}); err == nil {
-					unitool.Merge(includesConfig, subConfigEntity.config, true)
-				} else {
-					log.Warnf("LoadConfigEntity error: %v", err)
+				configMap := map[string]interface{}{"id": id, "title": title, "parent": c}
+				if format != "" {
+					configMap["format"] = format
+				}
+				subConfigEntity, err := source.LoadConfigEntity(configMap)
+				if err != nil {
+					if _, ok := err.(*alreadyLoadedError); ok {
+						log.Warnf("LoadConfigEntity error: %v", err)
+						continue
+					}
+					return err
 				}
+				unitool.MergeWithOrigins(includesConfig, subConfigEntity.config, mergeOptions, includesOrigins, subConfigEntity.origins)
 			}
 		}
+		c.origins.Move(IncludeListElementName, "from_processed")
 		c.config["from_processed"] = includes
 		delete(c.config, IncludeListElementName)
 	}
 	if c.config != nil {
-		unitool.Merge(includesConfig, c.config, true)
+		unitool.MergeWithOrigins(includesConfig, c.config, mergeOptions, includesOrigins, c.origins)
 		c.config = includesConfig
+		c.origins = includesOrigins
 	}
+	return nil
 }
@@ -0,0 +1,91 @@
+package uniconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error describes a failure occurred during phase execution.
+type Error struct {
+	Phase    string
+	Source   string
+	EntityID string
+	Path     string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, 0)
+	if e.Phase != "" {
+		parts = append(parts, "phase "+e.Phase)
+	}
+	if e.Source != "" {
+		parts = append(parts, "source "+e.Source)
+	}
+	if e.EntityID != "" {
+		parts = append(parts, "entity "+e.EntityID)
+	}
+	if e.Path != "" {
+		parts = append(parts, "key "+e.Path)
+	}
+	parts = append(parts, fmt.Sprint(e.Err))
+	return strings.Join(parts, ": ")
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors aggregates errors of all failed phases.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d error(s) occurred:\n* %s", len(e), strings.Join(messages, "\n* "))
+}
+
+// toErrors converts err into the flat list of errors, details of wrapping errors are kept in nested ones.
+func toErrors(err error) Errors {
+	switch e := err.(type) {
+	case Errors:
+		errs := make(Errors, 0, len(e))
+		for _, item := range e {
+			if item != nil {
+				errs = append(errs, toErrors(item)...)
+			}
+		}
+		return errs
+	case *Error:
+		nested, ok := e.Err.(Errors)
+		if !ok {
+			return Errors{e}
+		}
+		errs := toErrors(nested)
+		for _, item := range errs {
+			if item.Phase == "" {
+				item.Phase = e.Phase
+			}
+			if item.Source == "" {
+				item.Source, item.EntityID = e.Source, e.EntityID
+			}
+			if item.Path == "" {
+				item.Path = e.Path
+			}
+		}
+		return errs
+	}
+	return Errors{&Error{Err: err}}
+}
+
+// alreadyLoadedError is returned when the same config entity is included more than once.
+type alreadyLoadedError struct {
+	id string
+}
+
+func (e *alreadyLoadedError) Error() string {
+	return fmt.Sprintf("config entity already loaded: %s", e.id)
+}
@@ -0,0 +1,253 @@
+package uniconf
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/hashicorp/hil/ast"
+)
+
+var (
+	functions   = make(map[string]ast.Function)
+	functionsMu sync.RWMutex
+)
+
+func init() {
+	RegisterFunction("default", stringFunction(2, func(args []string) (interface{}, error) {
+		if args[0] == "" {
+			return args[1], nil
+		}
+		return args[0], nil
+	}))
+	RegisterFunction("coalesce", ast.Function{
+		Variadic:     true,
+		VariadicType: ast.TypeString,
+		ReturnType:   ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			for _, input := range inputs {
+				if s := input.(string); s != "" {
+					return s, nil
+				}
+			}
+			return "", nil
+		},
+	})
+	RegisterFunction("lower", stringFunction(1, func(args []string) (interface{}, error) {
+		return strings.ToLower(args[0]), nil
+	}))
+	RegisterFunction("upper", stringFunction(1, func(args []string) (interface{}, error) {
+		return strings.ToUpper(args[0]), nil
+	}))
+	RegisterFunction("replace", stringFunction(3, func(args []string) (interface{}, error) {
+		return strings.Replace(args[0], args[1], args[2], -1), nil
+	}))
+	RegisterFunction("regex_replace", stringFunction(3, func(args []string) (interface{}, error) {
+		r, err := regexp.Compile(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return r.ReplaceAllString(args[0], args[2]), nil
+	}))
+	RegisterFunction("join", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString, ast.TypeList},
+		ReturnType: ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			items := make([]string, 0)
+			for _, item := range inputs[1].([]ast.Variable) {
+				items = append(items, fmt.Sprint(hilValue(item.Value)))
+			}
+			return strings.Join(items, inputs[0].(string)), nil
+		},
+	})
+	RegisterFunction("split", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString, ast.TypeString},
+		ReturnType: ast.TypeList,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			items := make([]ast.Variable, 0)
+			for _, item := range strings.Split(inputs[1].(string), inputs[0].(string)) {
+				items = append(items, ast.Variable{Type: ast.TypeString, Value: item})
+			}
+			return items, nil
+		},
+	})
+	RegisterFunction("base64encode", stringFunction(1, func(args []string) (interface{}, error) {
+		return base64.StdEncoding.EncodeToString([]byte(args[0])), nil
+	}))
+	RegisterFunction("base64decode", stringFunction(1, func(args []string) (interface{}, error) {
+		decoded, err := base64.StdEncoding.DecodeString(args[0])
+		return string(decoded), err
+	}))
+	RegisterFunction("sha256", stringFunction(1, func(args []string) (interface{}, error) {
+		sum := sha256.Sum256([]byte(args[0]))
+		return hex.EncodeToString(sum[:]), nil
+	}))
+	RegisterFunction("json_encode", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeAny},
+		ReturnType: ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			encoded, err := json.Marshal(hilValue(inputs[0]))
+			return string(encoded), err
+		},
+	})
+	RegisterFunction("yaml_encode", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeAny},
+		ReturnType: ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			encoded, err := yaml.Marshal(hilValue(inputs[0]))
+			return string(encoded), err
+		},
+	})
+	RegisterFunction("keys", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeMap},
+		ReturnType: ast.TypeList,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			keys := make([]ast.Variable, 0)
+			for _, key := range sortedVariableKeys(inputs[0].(map[string]ast.Variable)) {
+				keys = append(keys, ast.Variable{Type: ast.TypeString, Value: key})
+			}
+			return keys, nil
+		},
+	})
+	RegisterFunction("values", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeMap},
+		ReturnType: ast.TypeList,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			m := inputs[0].(map[string]ast.Variable)
+			values := make([]ast.Variable, 0)
+			for _, key := range sortedVariableKeys(m) {
+				values = append(values, m[key])
+			}
+			return values, nil
+		},
+	})
+	RegisterFunction("env_or", stringFunction(2, func(args []string) (interface{}, error) {
+		if value, ok := os.LookupEnv(args[0]); ok {
+			return value, nil
+		}
+		return args[1], nil
+	}))
+}
+
+// RegisterFunction registers the function available in interpolations, existing function is replaced.
+// Functions of instances, e.g. deepGet, env, secret & file, take precedence over registered ones.
+func RegisterFunction(name string, function ast.Function) {
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+	functions[name] = function
+}
+
+// stringFunction returns the function of string arguments returning a string.
+func stringFunction(n int, callback func(args []string) (interface{}, error)) ast.Function {
+	argTypes := make([]ast.Type, n)
+	for i := range argTypes {
+		argTypes[i] = ast.TypeString
+	}
+	return ast.Function{
+		ArgTypes:   argTypes,
+		ReturnType: ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			args := make([]string, len(inputs))
+			for i, input := range inputs {
+				args[i] = input.(string)
+			}
+			return callback(args)
+		},
+	}
+}
+
+// funcMap returns registered functions & functions of the instance for the value at the path.
+func (u *Uniconf) funcMap(path string) map[string]ast.Function {
+	functionsMu.RLock()
+	funcMap := make(map[string]ast.Function, len(functions)+4)
+	for name, function := range functions {
+		funcMap[name] = function
+	}
+	functionsMu.RUnlock()
+
+	funcMap["file"] = stringFunction(1, func(args []string) (interface{}, error) {
+		filename := args[0]
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(u.sourcePathOf(path), filename)
+		}
+		stream, err := ioutil.ReadFile(filename)
+		return string(stream), err
+	})
+	return funcMap
+}
+
+// sourcePathOf returns the local path of the source which defined the value at the path,
+// relative paths are resolved against the working directory if the source doesn't have one.
+func (u *Uniconf) sourcePathOf(path string) string {
+	origins := u.origins[strings.Trim(path, ".")]
+	if len(origins) == 0 {
+		return ""
+	}
+	source, ok := u.sources[origins[len(origins)-1].Source]
+	if !ok || strings.Contains(source.Path(), "://") {
+		return ""
+	}
+	return source.Path()
+}
+
+// hilInput converts Go values to ones HIL variables can be made of, timestamps are RFC 3339 strings.
+func hilInput(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = hilInput(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = hilInput(item)
+		}
+		return l
+	}
+	return value
+}
+
+// hilValue converts HIL values to Go values, e.g. lists of variables to []interface{}.
+func hilValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case ast.Variable:
+		return hilValue(v.Value)
+	case []ast.Variable:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = hilValue(item.Value)
+		}
+		return l
+	case map[string]ast.Variable:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = hilValue(item.Value)
+		}
+		return m
+	}
+	return value
+}
+
+func sortedVariableKeys(m map[string]ast.Variable) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
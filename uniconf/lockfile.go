@@ -0,0 +1,203 @@
+package uniconf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aroq/uniconf/unitool"
+)
+
+// LockfileName is the default name of the lockfile.
+const LockfileName = "uniconf.lock"
+
+// SourceLockEntryProvider is implemented by sources which can be pinned in the lockfile.
+type SourceLockEntryProvider interface {
+	LockEntry() map[string]interface{}
+}
+
+// Lockfile records how sources were resolved, e.g. commits of repos & checksums of files.
+type Lockfile struct {
+	Sources map[string]interface{} `json:"sources"`
+}
+
+func LockSources() *Lockfile { return u.LockSources() }
+
+// LockSources returns the lockfile describing loaded sources.
+func (u *Uniconf) LockSources() *Lockfile {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	lockfile := &Lockfile{Sources: make(map[string]interface{})}
+	for name, source := range u.sources {
+		provider, ok := source.(SourceLockEntryProvider)
+		if !ok {
+			continue
+		}
+		lock := u.sourceLock(name)
+		lock.Lock()
+		if source.IsLoaded() {
+			lockfile.Sources[name] = provider.LockEntry()
+		}
+		lock.Unlock()
+	}
+	return lockfile
+}
+
+// ReadLockfile reads the lockfile.
+func ReadLockfile(filename string) (*Lockfile, error) {
+	stream, err := unitool.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := unitool.UnmarshalYaml(stream)
+	if err != nil {
+		return nil, fmt.Errorf("lockfile %s: %v", filename, err)
+	}
+	lockfile := &Lockfile{Sources: make(map[string]interface{})}
+	if sources, ok := m["sources"].(map[string]interface{}); ok {
+		lockfile.Sources = sources
+	}
+	return lockfile, nil
+}
+
+// Write writes the lockfile.
+func (l *Lockfile) Write(filename string) error {
+	return ioutil.WriteFile(filename, []byte(unitool.MarshallYaml(l)), 0644)
+}
+
+// Verify compares sources with the locked ones and returns Errors describing differences.
+func (l *Lockfile) Verify(locked *Lockfile) error {
+	var errs Errors
+	for _, name := range sortedKeys(l.Sources, locked.Sources) {
+		entry, ok := l.Sources[name]
+		if !ok {
+			errs = append(errs, &Error{Source: name, Err: fmt.Errorf("source is locked but was not loaded")})
+			continue
+		}
+		lockedEntry, ok := locked.Sources[name]
+		if !ok {
+			errs = append(errs, &Error{Source: name, Err: fmt.Errorf("source is not locked")})
+			continue
+		}
+		values, lockedValues := make(map[string]string), make(map[string]string)
+		flattenValues("", entry, values)
+		flattenValues("", lockedEntry, lockedValues)
+		for _, key := range sortedKeys(values, lockedValues) {
+			value, ok := values[key]
+			if !ok {
+				value = "<none>"
+			}
+			lockedValue, ok := lockedValues[key]
+			if !ok {
+				lockedValue = "<none>"
+			}
+			if value != lockedValue {
+				errs = append(errs, &Error{Source: name, Path: key, Err: fmt.Errorf("locked %s, resolved %s", lockedValue, value)})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func WriteLockfile(inputs []interface{}) (interface{}, error) { return u.WriteLockfile(inputs) }
+
+// WriteLockfile writes the lockfile of loaded sources, "uniconf.lock" is used if file name is not given.
+func (u *Uniconf) WriteLockfile(inputs []interface{}) (interface{}, error) {
+	filename := lockfileName(inputs)
+	if err := u.LockSources().Write(filename); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func VerifyLockfile(inputs []interface{}) (interface{}, error) { return u.VerifyLockfile(inputs) }
+
+// VerifyLockfile fails if loaded sources are resolved differently than in the lockfile.
+func (u *Uniconf) VerifyLockfile(inputs []interface{}) (interface{}, error) {
+	locked, err := ReadLockfile(lockfileName(inputs))
+	if err != nil {
+		return nil, err
+	}
+	return nil, u.LockSources().Verify(locked)
+}
+
+func lockfileName(inputs []interface{}) string {
+	if len(inputs) > 0 {
+		if filename, ok := inputs[0].(string); ok && filename != "" {
+			return filename
+		}
+	}
+	return LockfileName
+}
+
+func sortedKeys(maps ...interface{}) []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, m := range maps {
+		switch m := m.(type) {
+		case map[string]interface{}:
+			for key := range m {
+				add(key)
+			}
+		case map[string]string:
+			for key := range m {
+				add(key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fileChecksum returns sha256 checksum of the content.
+func fileChecksum(content []byte) string {
+	hash := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// dirChecksum returns sha256 checksum of paths & contents of all files in the directory.
+func dirChecksum(dir string) (string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
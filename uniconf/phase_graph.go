@@ -0,0 +1,148 @@
+package uniconf
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// validatePhases checks dependencies of the phases tree: names of dependent siblings
+// should be unique & existing, and dependencies should not form cycles.
+func validatePhases(parentPhase *Phase, phases []*Phase) *Error {
+	parentName := ""
+	if parentPhase != nil {
+		parentName = phaseFullName(parentPhase)
+	}
+	graph := false
+	for _, phase := range phases {
+		if len(phase.DependsOn) > 0 {
+			graph = true
+		}
+	}
+	if graph {
+		byName := make(map[string]*Phase)
+		for _, phase := range phases {
+			if _, ok := byName[phase.Name]; ok {
+				return &Error{Phase: parentName, Err: fmt.Errorf("duplicate phase name: %s", phase.Name)}
+			}
+			byName[phase.Name] = phase
+		}
+		for _, phase := range phases {
+			for _, dependency := range phase.DependsOn {
+				if _, ok := byName[dependency]; !ok {
+					return &Error{Phase: parentName, Err: fmt.Errorf("phase %s depends on unknown phase: %s", phase.Name, dependency)}
+				}
+			}
+		}
+		if cycle := phasesCycle(phases, byName); cycle != nil {
+			return &Error{Phase: parentName, Err: fmt.Errorf("phase dependency cycle: %s", strings.Join(cycle, " -> "))}
+		}
+	}
+	for _, phase := range phases {
+		if phase.Phases != nil {
+			phase.ParentPhase = parentPhase
+			if err := validatePhases(phase, phase.Phases); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// phasesCycle returns names of phases forming a dependency cycle if there is one.
+func phasesCycle(phases []*Phase, byName map[string]*Phase) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	stack := make([]string, 0)
+	var visit func(phase *Phase) []string
+	visit = func(phase *Phase) []string {
+		state[phase.Name] = visiting
+		stack = append(stack, phase.Name)
+		for _, dependency := range phase.DependsOn {
+			switch state[dependency] {
+			case visiting:
+				for i, name := range stack {
+					if name == dependency {
+						return append(append([]string{}, stack[i:]...), dependency)
+					}
+				}
+			case unvisited:
+				if cycle := visit(byName[dependency]); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[phase.Name] = visited
+		return nil
+	}
+	for _, phase := range phases {
+		if state[phase.Name] == unvisited {
+			if cycle := visit(phase); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// executeGraph executes phases in dependency order, phases which don't depend on each other
+// are executed concurrently.
+func (u *Uniconf) executeGraph(phases []*Phase) (errs Errors, aborted bool) {
+	type phaseResult struct {
+		phase   *Phase
+		errs    Errors
+		aborted bool
+	}
+
+	pending := make(map[string]int)
+	dependents := make(map[string][]*Phase)
+	for _, phase := range phases {
+		pending[phase.Name] = len(phase.DependsOn)
+		for _, dependency := range phase.DependsOn {
+			dependents[dependency] = append(dependents[dependency], phase)
+		}
+	}
+
+	results := make(chan phaseResult)
+	var wg sync.WaitGroup
+	running := 0
+	start := func(phase *Phase) {
+		running++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			phaseErrs, phaseAborted := u.executePhase(phase)
+			results <- phaseResult{phase: phase, errs: phaseErrs, aborted: phaseAborted}
+		}()
+	}
+
+	for _, phase := range phases {
+		if pending[phase.Name] == 0 {
+			start(phase)
+		}
+	}
+	for running > 0 {
+		result := <-results
+		running--
+		errs = append(errs, result.errs...)
+		if result.aborted {
+			aborted = true
+		}
+		if aborted {
+			continue
+		}
+		for _, phase := range dependents[result.phase.Name] {
+			pending[phase.Name]--
+			if pending[phase.Name] == 0 {
+				start(phase)
+			}
+		}
+	}
+	wg.Wait()
+	return errs, aborted
+}
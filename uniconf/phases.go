@@ -1,30 +1,40 @@
 package uniconf
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aroq/uniconf/unitool"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 //func (u *Uniconf) setCurrentPhase(name string) {
 //	u.currentPhase = u.phases[name]
 //}
 
-func AddPhase(phase *Phase) { u.addPhase(phase) }
-func (u *Uniconf) addPhase(phase *Phase) {
+func AddPhase(phase *Phase) { u.AddPhase(phase) }
+
+// AddPhase appends phase to the list of phases to execute.
+func (u *Uniconf) AddPhase(phase *Phase) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.phases[phase.Name] = phase
 	u.phasesList = append(u.phasesList, phase)
 }
 
+func Load(inputs []interface{}) (interface{}, error) { return u.Load(inputs) }
+
 // Load loads configuration.
-func Load(inputs []interface{}) (interface{}, error) { return u.load(inputs) }
+func (u *Uniconf) Load(inputs []interface{}) (interface{}, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.load(inputs)
+}
+
 func (u *Uniconf) load(inputs []interface{}) (interface{}, error) {
 	log.Info("load")
 	if len(u.config) == 0 {
@@ -35,10 +45,13 @@ func (u *Uniconf) load(inputs []interface{}) (interface{}, error) {
 			configMap := map[string]interface{}{
 				"id": "root",
 			}
-			if c, err := u.rootSource.LoadConfigEntity(configMap); err == nil {
-				u.mergeConfigEntity(c)
-			} else {
-				log.Errorf("Config entity is not loaded")
+			c, err := u.rootSource.LoadConfigEntity(configMap)
+			if err != nil {
+				return nil, err
+			}
+			u.mergeConfigEntity(c)
+			if metadata := u.sourcesMetadata(); len(metadata) > 0 {
+				u.config[SourcesMetadataElementName] = metadata
 			}
 		}
 	}
@@ -46,10 +59,63 @@ func (u *Uniconf) load(inputs []interface{}) (interface{}, error) {
 	return nil, nil
 }
 
+func LoadSources(inputs []interface{}) (interface{}, error) { return u.LoadSources(inputs) }
+
+// LoadSources concurrently loads sources with given names, all registered sources are loaded if no names are given.
+// It doesn't lock the instance while sources are loaded, so it can be executed in a concurrent phase.
+func (u *Uniconf) LoadSources(inputs []interface{}) (interface{}, error) {
+	u.mu.RLock()
+	sources := make([]SourceHandler, 0)
+	if len(inputs) > 0 {
+		for _, name := range inputs {
+			source, ok := u.sources[fmt.Sprint(name)]
+			if !ok {
+				u.mu.RUnlock()
+				return nil, &Error{Source: fmt.Sprint(name), Err: errors.New("source is not registered")}
+			}
+			sources = append(sources, source)
+		}
+	} else {
+		for _, source := range u.sources {
+			sources = append(sources, source)
+		}
+	}
+	u.mu.RUnlock()
+
+	if errs := u.loadSources(sources); len(errs) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
+
+// loadSources concurrently loads sources which aren't loaded yet, it returns errors of all failed sources.
+func (u *Uniconf) loadSources(sources []SourceHandler) Errors {
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	var errs Errors
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source SourceHandler) {
+			defer wg.Done()
+			if err := u.loadSource(source); err != nil {
+				errsMu.Lock()
+				errs = append(errs, toErrors(err)...)
+				errsMu.Unlock()
+			}
+		}(source)
+	}
+	wg.Wait()
+	return errs
+}
+
 func DeepCollectChildren(inputs []interface{}) (interface{}, error) {
-	return u.deepCollectChildren(inputs)
+	return u.DeepCollectChildren(inputs)
 }
-func (u *Uniconf) deepCollectChildren(inputs []interface{}) (interface{}, error) {
+
+// DeepCollectChildren collects children params of the path.
+func (u *Uniconf) DeepCollectChildren(inputs []interface{}) (interface{}, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	if len(inputs) > 1 {
 		path := inputs[0].(string)
 		key := inputs[1].(string)
@@ -59,37 +125,49 @@ func (u *Uniconf) deepCollectChildren(inputs []interface{}) (interface{}, error)
 	return nil, nil
 }
 
-func ProcessContext(inputs []interface{}) (interface{}, error) { return u.processContext(inputs) }
-func (u *Uniconf) processContext(inputs []interface{}) (interface{}, error) {
+func ProcessContext(inputs []interface{}) (interface{}, error) { return u.ProcessContext(inputs) }
+
+// ProcessContext processes the entity and stores it as a context.
+func (u *Uniconf) ProcessContext(inputs []interface{}) (interface{}, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if len(inputs) > 1 {
 		entityName := inputs[0].(string)
 		entityID := inputs[1].(string)
 		if _, ok := u.config["entities"]; ok {
 			// Get entity handler from the config.
-			entityHandler := u.config["entities"].(map[string]interface{})[entityName].(map[string]interface{})
+			entityHandler, ok := unitool.SearchMapWithPathStringPrefixes(u.config, "entities."+entityName).(map[string]interface{})
+			if !ok {
+				return nil, &Error{Path: "entities." + entityName, Err: errors.New("entity handler is not defined")}
+			}
 			// childrenKey determines key in config used to hold child items.
-			childrenKey := entityHandler["children_key"].(string)
+			childrenKey, ok := entityHandler["children_key"].(string)
+			if !ok {
+				return nil, &Error{Path: "entities." + entityName + ".children_key", Err: errors.New("children key is not defined")}
+			}
 
 			processors := make([]*Processor, 0)
-			if processorsList, ok := entityHandler["processors"]; ok {
-				for _, processor := range processorsList.([]interface{}) {
-					if processor.(string) == "from_processor" {
-						processors = append(
-							processors,
-							&Processor{
-								Callback:    FromProcess,
-								IncludeKeys: []string{"from"},
-							})
-					}
+			if processorsList, ok := entityHandler["processors"].([]interface{}); ok {
+				var err error
+				if processors, err = u.processorsByName(processorsList); err != nil {
+					return nil, &Error{Path: "entities." + entityName + ".processors", Err: err}
 				}
 			}
-			ProcessKeys([]interface{}{childrenKey, "", processors})
+			if _, err := u.processKeys([]interface{}{childrenKey, "", processors}); err != nil {
+				return nil, err
+			}
 
-			switch entityHandler["retrieve_handler"].(string) {
+			switch retrieveHandler := entityHandler["retrieve_handler"]; retrieveHandler {
 			case "DeepCollectChildren":
-				entity, _ := unitool.DeepCollectChildren(u.config, entityID, childrenKey)
-				u.setContextObject(entityHandler["context_name"].(string), entity)
+				contextName, ok := entityHandler["context_name"].(string)
+				if !ok {
+					return nil, &Error{Path: "entities." + entityName + ".context_name", Err: errors.New("context name is not defined")}
+				}
+				entity, origins, _ := unitool.DeepCollectChildrenWithOrigins(u.config, entityID, childrenKey, u.origins)
+				u.setContextObject(contextName, entity, origins)
 				return entity, nil
+			default:
+				return nil, &Error{Path: "entities." + entityName + ".retrieve_handler", Err: fmt.Errorf("unknown retrieve handler: %v", retrieveHandler)}
 			}
 		} else {
 			return nil, errors.New("config contexts are not defined")
@@ -98,52 +176,94 @@ func (u *Uniconf) processContext(inputs []interface{}) (interface{}, error) {
 	return nil, nil
 }
 
-func SetContext(inputs []interface{}) (interface{}, error) { return u.setContext(inputs) }
-func (u *Uniconf) setContext(inputs []interface{}) (interface{}, error) {
+func SetContext(inputs []interface{}) (interface{}, error) { return u.SetContext(inputs) }
+
+// SetContext stores the object as a named context.
+func (u *Uniconf) SetContext(inputs []interface{}) (interface{}, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if len(inputs) > 1 {
 		contextName := inputs[0].(string)
 		i2 := inputs[1].(*interface{})
 		i3 := *i2
 		object := i3.(map[string]interface{})
 		if object != nil {
-			u.setContextObject(contextName, object)
+			u.setContextObject(contextName, object, nil)
 		}
 	}
 	return nil, nil
 }
 
-func (u *Uniconf) setContextObject(contextName string, context map[string]interface{}) {
+// setContextObject stores the context object & merges its "context" map into the config,
+// origins of the object values are keyed by their paths in the object.
+func (u *Uniconf) setContextObject(contextName string, context map[string]interface{}, origins unitool.Origins) {
 	if _, ok := u.config["contexts"]; !ok {
 		u.config["contexts"] = make(map[string]interface{})
 	}
 	u.config["contexts"].(map[string]interface{})[contextName] = context
+	path := "contexts." + contextName
+	u.origins.DeleteTree(path)
+	for p, o := range origins {
+		u.origins[unitool.JoinPath(path, p)] = o
+	}
 	if context, ok := context["context"]; ok {
-		unitool.Merge(u.config, context, true)
+		unitool.MergeWithOrigins(u.config, context, unitool.MergeOptions{Override: true}, u.origins, origins.Subtree("context"))
 	}
 }
 
-func FlattenConfig(inputs []interface{}) (interface{}, error) { return u.flattenConfig(inputs) }
-func (u *Uniconf) flattenConfig(inputs []interface{}) (interface{}, error) {
-	viper := viper.New()
-	var yamlConfig = []byte(GetYAML())
-	viper.SetConfigType("yaml")
-	viper.ReadConfig(bytes.NewBuffer(yamlConfig))
-	u.flatConfig = u.allSettings(viper)
+func FlattenConfig(inputs []interface{}) (interface{}, error) { return u.FlattenConfig(inputs) }
+
+// FlattenConfig is kept for declarative phases using it, it only logs the deprecation warning.
+//
+// Deprecated: interpolation reads the current config, use Resolve to resolve interpolations in dependency order.
+func (u *Uniconf) FlattenConfig(inputs []interface{}) (interface{}, error) {
+	log.Warn("The flatten_config phase callback is deprecated and does nothing, interpolations read the current config, use the resolve callback to resolve them")
 	return nil, nil
 }
 
-func PrintConfig(inputs []interface{}) (interface{}, error) { return u.printConfig(inputs) }
-func (u *Uniconf) printConfig(inputs []interface{}) (interface{}, error) {
+func PrintConfig(inputs []interface{}) (interface{}, error) { return u.PrintConfig(inputs) }
+
+// PrintConfig prints config or its subtree by the path, the optional second input is the output format ("yaml" by default)
+// and the third one is the map of encoding options: "separator", "key_case" & "prefix".
+func (u *Uniconf) PrintConfig(inputs []interface{}) (interface{}, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.outputConfig()
+	if err != nil {
+		return nil, err
+	}
+	var value interface{} = config
 	if len(inputs) > 0 {
-		path := inputs[0].(string)
-		fmt.Println(unitool.MarshallYaml(unitool.SearchMapWithPathStringPrefixes(u.config, path)))
-	} else {
-		fmt.Println(unitool.MarshallYaml(u.config))
+		if path, _ := inputs[0].(string); path != "" {
+			value = unitool.SearchMapWithPathStringPrefixes(config, path)
+		}
 	}
+	format := "yaml"
+	if len(inputs) > 1 {
+		format = fmt.Sprint(inputs[1])
+	}
+	options := unitool.EncodeOptions{}
+	if len(inputs) > 2 {
+		m, ok := inputs[2].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("encoding options should be a map, got %T", inputs[2])
+		}
+		options.Separator, _ = m["separator"].(string)
+		options.KeyCase, _ = m["key_case"].(string)
+		options.Prefix, _ = m["prefix"].(string)
+	}
+	stream, err := unitool.Encode(format, value, options)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(string(stream))
 	return nil, nil
 }
 
-func processKeys(key string, source interface{}, parent interface{}, path string, phase *Phase, processors []*Processor, depth int, excludeKeys []string) {
+// processValues applies processors to string values of the source, set replaces the source in its parent.
+// Values which failed to be processed are left as is, errors of all values are returned.
+func (u *Uniconf) processValues(key string, source interface{}, parent interface{}, set func(value interface{}), path string, phase *Phase, processors []*Processor, depth int, excludeKeys []string) Errors {
+	var errs Errors
 	if depth > -100 {
 		switch source.(type) {
 		case string:
@@ -159,11 +279,32 @@ func processKeys(key string, source interface{}, parent interface{}, path string
 					if !skip {
 						log.Debugf("processKeys path: %s, key: %s", path, key)
 						value := source.(string)
-						result, processed, mergeToParent, removeParentKey, replaceSource := processor.Callback(value, path, phase)
+						result, processed, mergeToParent, removeParentKey, replaceSource, err := u.callProcessor(processor, value, path, phase)
+						if err != nil {
+							for _, e := range toErrors(err) {
+								if e.Path == "" {
+									e.Path = strings.Trim(path, ".")
+								}
+								errs = append(errs, e)
+							}
+							break
+						}
+						if processed && !mergeToParent && !removeParentKey {
+							// The value is replaced in place, e.g. by the interpolated one.
+							if set != nil {
+								set(result)
+							}
+							s, ok := result.(string)
+							if !ok {
+								break
+							}
+							source = s
+							continue
+						}
 						if result != nil {
 							result, _ = unitool.DeepCopyMap(result.(map[string]interface{}))
 							if mergeToParent {
-								unitool.Merge(parent, result, false)
+								u.mergeToParent(parent.(map[string]interface{}), result.(map[string]interface{}), path, replaceSource)
 							}
 							if removeParentKey {
 								log.Debugf("remove from list: %s", value)
@@ -194,7 +335,7 @@ func processKeys(key string, source interface{}, parent interface{}, path string
 							if mergeToParent {
 								parts := strings.Split(path, ".")
 								p := strings.Join(parts[:len(parts)-1], ".")
-								processKeys("", parent, source, p, phase, processors, depth, excludeKeys)
+								errs = append(errs, u.processValues("", parent, source, nil, p, phase, processors, depth, excludeKeys)...)
 							}
 						}
 					}
@@ -210,19 +351,53 @@ func processKeys(key string, source interface{}, parent interface{}, path string
 					p = strings.Join([]string{path, strconv.Itoa(i)}, ".")
 				}
 				//log.Debugf("processKeys() []interface{: %v", l)
-				processKeys(key, l[i], parent, p, phase, processors, depth, excludeKeys)
+				i := i
+				set := func(value interface{}) { l[i] = value }
+				errs = append(errs, u.processValues(key, l[i], parent, set, p, phase, processors, depth, excludeKeys)...)
 			}
 		case map[string]interface{}:
-			for k, v := range source.(map[string]interface{}) {
+			m := source.(map[string]interface{})
+			for k, v := range m {
 				depth--
 				if !stringListContains(excludeKeys, k) {
-					processKeys(k, v, source, strings.Join([]string{path, k}, "."), phase, processors, depth, excludeKeys)
+					k := k
+					set := func(value interface{}) { m[k] = value }
+					errs = append(errs, u.processValues(k, v, source, set, strings.Join([]string{path, k}, "."), phase, processors, depth, excludeKeys)...)
 				} else {
 					log.Debugf("Key skipped as excluded by parent: %s", k)
 				}
 			}
 		}
 	}
+	return errs
+}
+
+// callProcessor calls the processor callback with the instance unlocked, processValues is called while it is locked.
+func (u *Uniconf) callProcessor(processor *Processor, value string, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error) {
+	u.mu.Unlock()
+	defer u.mu.Lock()
+	return processor.Callback(value, path, phase)
+}
+
+// mergeToParent merges the processor result into the parent of the value at the path without overriding its values,
+// origins of merged "from" params are ones of the values they were collected from.
+func (u *Uniconf) mergeToParent(parent, result map[string]interface{}, path string, from interface{}) {
+	path = strings.Trim(path, ".")
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		path = path[:i]
+	} else {
+		path = ""
+	}
+	origins := u.origins.Subtree(path)
+	var resultOrigins unitool.Origins
+	if from, ok := from.(string); ok {
+		resultOrigins = u.processedFromOrigins[from]
+	}
+	unitool.MergeWithOrigins(parent, result, unitool.MergeOptions{}, origins, resultOrigins)
+	u.origins.DeleteTree(path)
+	for p, o := range origins {
+		u.origins[unitool.JoinPath(path, p)] = o
+	}
 }
 
 func stringListContains(s []string, e string) bool {
@@ -234,24 +409,57 @@ func stringListContains(s []string, e string) bool {
 	return false
 }
 
+func ProcessKeys(inputs []interface{}) (interface{}, error) { return u.ProcessKeys(inputs) }
+
 // ProcessKeys processes configuration.
-func ProcessKeys(inputs []interface{}) (interface{}, error) { return u.processKeys(inputs) }
+func (u *Uniconf) ProcessKeys(inputs []interface{}) (interface{}, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.processKeys(inputs)
+}
+
 func (u *Uniconf) processKeys(inputs []interface{}) (interface{}, error) {
 	path := inputs[0].(string)
 	keys := strings.Split(path, ".")
-	keyPrefix := inputs[1].(string)
+	keyPrefix := ""
+	if len(inputs) > 1 {
+		keyPrefix = inputs[1].(string)
+	}
 	if keyPrefix != "" {
 		keyPrefix = "." + keyPrefix
 	}
-	processors := inputs[2].([]*Processor)
+	var processors []*Processor
+	if len(inputs) > 2 {
+		switch p := inputs[2].(type) {
+		case []*Processor:
+			processors = p
+		case []interface{}:
+			// Processors are referenced by names in declarative phases.
+			var err error
+			if processors, err = u.processorsByName(p); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &Error{Path: path, Err: fmt.Errorf("processors should be a list, got %T", inputs[2])}
+		}
+	}
 	p := ""
+	errs := make(Errors, 0)
 	for _, v := range keys {
 		p = strings.Trim(p+keyPrefix+"."+v, ".")
 		var source interface{} = u.config
 		if p != "" {
 			source = unitool.SearchMapWithPathStringPrefixes(u.config, p)
 		}
-		processKeys("", source, nil, p, u.currentPhase, processors, 1, []string{keyPrefix})
+		errs = append(errs, u.processValues("", source, nil, nil, p, u.currentPhase, processors, 1, []string{keyPrefix})...)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			if origin, ok := u.originOf(e.Path); ok && e.Source == "" {
+				e.Source, e.EntityID = origin.Source, origin.EntityID
+			}
+		}
+		return nil, errs
 	}
 	return u.config, nil
 }
@@ -0,0 +1,177 @@
+package uniconf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PhasesElementName is the config key holding declarative phases.
+const PhasesElementName = "phases"
+
+// phaseCallbacks holds callbacks available in declarative phases.
+var phaseCallbacks = map[string]func(*Uniconf, []interface{}) (interface{}, error){
+	"load":                  (*Uniconf).Load,
+	"flatten_config":        (*Uniconf).FlattenConfig,
+	"process_keys":          (*Uniconf).ProcessKeys,
+	"process_context":       (*Uniconf).ProcessContext,
+	"print_config":          (*Uniconf).PrintConfig,
+	"deep_collect_children": (*Uniconf).DeepCollectChildren,
+	"load_sources":          (*Uniconf).LoadSources,
+	"write_lockfile":        (*Uniconf).WriteLockfile,
+	"verify_lockfile":       (*Uniconf).VerifyLockfile,
+	"validate":              (*Uniconf).Validate,
+	"resolve":               (*Uniconf).Resolve,
+}
+
+// concurrentPhaseCallbacks holds callbacks which are always executed concurrently.
+var concurrentPhaseCallbacks = map[string]bool{
+	"load_sources": true,
+}
+
+func LoadPhases(pipeline string) (bool, error) { return u.LoadPhases(pipeline) }
+
+// LoadPhases loads configuration and adds phases declared in its "phases" key.
+// The key holds either a list of phases or a map of named pipelines.
+// It returns false if configuration doesn't declare any phases for the pipeline.
+func (u *Uniconf) LoadPhases(pipeline string) (bool, error) {
+	if _, err := u.Load(nil); err != nil {
+		return false, err
+	}
+	u.mu.RLock()
+	definition, ok := u.config[PhasesElementName]
+	u.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	path := PhasesElementName
+	if pipelines, ok := definition.(map[string]interface{}); ok {
+		if definition, ok = pipelines[pipeline]; !ok {
+			return false, nil
+		}
+		path += "." + pipeline
+	}
+	phases, err := u.PhasesFromConfig(definition)
+	if err != nil {
+		return false, &Error{Path: path, Err: err}
+	}
+	for _, phase := range phases {
+		u.AddPhase(phase)
+	}
+	return true, nil
+}
+
+// PhasesFromConfig builds phases from the declarative definition, e.g.:
+//
+//   - name: process
+//     callback: process_keys
+//     args: [jobs, "", [from_processor, {name: interpolate, exclude_keys: [from]}]]
+//     on_error: continue
+//     depends_on: [load]
+//     concurrent: false
+//     phases: [...]
+//
+// String args containing "${...}" are interpolated when the phase is executed, args consisting of exactly one
+// interpolation keep types of referenced values.
+func (u *Uniconf) PhasesFromConfig(definition interface{}) ([]*Phase, error) {
+	list, ok := definition.([]interface{})
+	if !ok {
+		return nil, errors.New("phases definition should be a list")
+	}
+	phases := make([]*Phase, 0, len(list))
+	for i, item := range list {
+		phase, err := u.phaseFromConfig(item)
+		if err != nil {
+			return nil, fmt.Errorf("phase %d: %v", i, err)
+		}
+		phases = append(phases, phase)
+	}
+	return phases, nil
+}
+
+func (u *Uniconf) phaseFromConfig(definition interface{}) (*Phase, error) {
+	m, ok := definition.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("phase definition should be a map")
+	}
+	name, ok := m["name"].(string)
+	if !ok || name == "" {
+		return nil, errors.New("phase name is not defined")
+	}
+	phase := &Phase{Name: name}
+
+	if onError, ok := m["on_error"]; ok {
+		switch onError {
+		case PhaseErrorAbort, PhaseErrorContinue, PhaseErrorSkipChildren:
+			phase.OnError = onError.(string)
+		default:
+			return nil, fmt.Errorf("%s: unknown on_error policy: %v", name, onError)
+		}
+	}
+
+	if dependsOn, ok := m["depends_on"]; ok {
+		list, ok := dependsOn.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: depends_on should be a list", name)
+		}
+		for _, dependency := range list {
+			phase.DependsOn = append(phase.DependsOn, fmt.Sprint(dependency))
+		}
+	}
+
+	if concurrent, ok := m["concurrent"].(bool); ok {
+		phase.Concurrent = concurrent
+	}
+
+	if args, ok := m["args"]; ok {
+		list, ok := args.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: args should be a list", name)
+		}
+		phase.Args = list
+	}
+
+	if callbackName, ok := m["callback"]; ok {
+		callback, ok := phaseCallbacks[fmt.Sprint(callbackName)]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown callback: %v", name, callbackName)
+		}
+		if concurrentPhaseCallbacks[fmt.Sprint(callbackName)] {
+			phase.Concurrent = true
+		}
+		phase.Callback = func(args []interface{}) (interface{}, error) {
+			args, err := u.interpolateArgs(args)
+			if err != nil {
+				return nil, err
+			}
+			return callback(u, args)
+		}
+	}
+
+	if children, ok := m["phases"]; ok {
+		phases, err := u.PhasesFromConfig(children)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		phase.Phases = phases
+	}
+	return phase, nil
+}
+
+func (u *Uniconf) interpolateArgs(args []interface{}) ([]interface{}, error) {
+	result := make([]interface{}, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok && strings.Contains(s, "${") {
+			value, err := u.Interpolate(s, nil)
+			if err != nil {
+				return nil, err
+			}
+			log.Debugf("Phase arg interpolated: %s -> %v", s, u.loggedValue(s, value))
+			arg = value
+		}
+		result[i] = arg
+	}
+	return result, nil
+}
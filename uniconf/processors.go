@@ -1,8 +1,11 @@
 package uniconf
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"os"
 
@@ -12,110 +15,630 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Modes of undefined references in interpolations. In all modes "$${" is the escape of the literal "${",
+// it is kept in config values and unescaped in output, so interpolated values can be interpolated again.
+const (
+	// UndefinedStrict reports all undefined references of the value (default).
+	UndefinedStrict = "strict"
+	// UndefinedKeep leaves interpolations with undefined references as is, e.g. for Jenkins to expand "${GIT_COMMIT}".
+	UndefinedKeep = "keep"
+	// UndefinedEmpty replaces interpolations with undefined references with empty strings.
+	UndefinedEmpty = "empty"
+)
+
+// Processor processes config values in ProcessKeys. Callbacks are called while the instance is unlocked,
+// so they can call its exported methods, e.g. Config or InterpolateString.
 type Processor struct {
 	IncludeKeys []string
 	ExcludeKeys []string
-	Callback    func(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{})
+	Callback    func(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error)
+}
+
+// ProcessorFactory creates the processor of the instance from its options declared in config.
+// Processors referenced by names have "include_keys" & "exclude_keys" options which set their keys filters.
+type ProcessorFactory func(u *Uniconf, options map[string]interface{}) (*Processor, error)
+
+var (
+	processorTypes   = make(map[string]ProcessorFactory)
+	processorTypesMu sync.RWMutex
+)
+
+func init() {
+	RegisterProcessor("from_processor", func(u *Uniconf, options map[string]interface{}) (*Processor, error) {
+		return &Processor{Callback: u.FromProcess, IncludeKeys: []string{IncludeListElementName}}, nil
+	})
+	RegisterProcessor("interpolate", func(u *Uniconf, options map[string]interface{}) (*Processor, error) {
+		return &Processor{Callback: u.InterpolateProcess}, nil
+	})
+}
+
+// RegisterProcessor registers the factory creating processors referenced by the name, existing factory is replaced.
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processorTypesMu.Lock()
+	defer processorTypesMu.Unlock()
+	processorTypes[name] = factory
+}
+
+// processorsByName returns processors referenced by names, e.g. "interpolate",
+// or by maps of names & options, e.g. "{name: interpolate, exclude_keys: [from]}".
+func (u *Uniconf) processorsByName(names []interface{}) ([]*Processor, error) {
+	processors := make([]*Processor, 0)
+	for _, item := range names {
+		name, options := item, map[string]interface{}{}
+		if m, ok := item.(map[string]interface{}); ok {
+			name, options = m["name"], m
+		}
+		processorTypesMu.RLock()
+		factory, ok := processorTypes[fmt.Sprint(name)]
+		processorTypesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown processor: %v", name)
+		}
+		processor, err := factory(u, options)
+		if err != nil {
+			return nil, fmt.Errorf("processor %v: %v", name, err)
+		}
+		for option, keys := range map[string]*[]string{"include_keys": &processor.IncludeKeys, "exclude_keys": &processor.ExcludeKeys} {
+			value, ok := options[option]
+			if !ok {
+				continue
+			}
+			if *keys, err = processorKeys(value); err != nil {
+				return nil, fmt.Errorf("processor %v: %s: %v", name, option, err)
+			}
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
 }
 
-var processedFromKeys = make(map[string]interface{})
+// processorKeys converts the keys filter option to the list of keys.
+func processorKeys(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("keys should be a list, got %T", value)
+	}
+	keys := make([]string, 0, len(list))
+	for _, key := range list {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	return keys, nil
+}
+
+func InterpolateProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error) {
+	return u.InterpolateProcess(source, path, phase)
+}
 
-func InterpolateProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}) {
-	if strings.Contains(source.(string), "${") {
-		s := InterpolateString(source.(string), u.flatConfig)
-		return s, true, false, false, s
+// InterpolateProcess replaces string values with interpolated ones, values consisting of exactly one interpolation
+// are replaced with referenced values of their original types.
+func (u *Uniconf) InterpolateProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if hasInterpolations(source.(string)) {
+		value, err := u.interpolate(source.(string), u.config, path)
+		if err != nil {
+			return nil, false, false, false, nil, err
+		}
+		return value, true, false, false, nil, nil
 	}
 
-	return nil, false, false, false, nil
+	return nil, false, false, false, nil, nil
+}
+
+func FromProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error) {
+	return u.FromProcess(source, path, phase)
 }
 
-func FromProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}) {
-	from := InterpolateString(source.(string), u.flatConfig)
-	if result, ok := processedFromKeys[from]; ok {
+// FromProcess merges params referenced by "from" keys.
+func (u *Uniconf) FromProcess(source interface{}, path string, phase *Phase) (result interface{}, processed, mergeToParent, removeParentKey bool, replaceSource interface{}, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	from, err := u.interpolateString(source.(string), u.config, path)
+	if err != nil {
+		return nil, false, false, false, nil, err
+	}
+	if result, ok := u.processedFromKeys[from]; ok {
 		log.Debugf("FromProcess() - already processed: %v", from)
-		return result, true, true, true, from
+		return result, true, true, true, from, nil
+	}
+
+	if chain := u.fromCycle(from, []string{from}); chain != nil {
+		return nil, false, false, false, nil, fmt.Errorf("%s cycle: %s", IncludeListElementName, strings.Join(chain, " -> "))
 	}
 
 	processorParams, err := unitool.DeepCollectParams(u.config, from, "processors")
 	if err != nil {
-		log.Errorf("Error: %v", err)
+		return nil, false, false, false, nil, err
 	}
 	fromMode := ""
 	if len(processorParams) > 0 {
-		fromMode = unitool.SearchMapWithPathStringPrefixes(processorParams, "from.mode").(string)
+		if mode, ok := unitool.SearchMapWithPathStringPrefixes(processorParams, "from.mode").(string); ok {
+			fromMode = mode
+		}
 	}
 	modeParam := fromMode
 	phaseName := phaseFullName(phase)
 	if (modeParam != "" && strings.HasPrefix(phaseName, modeParam)) || (modeParam == "") {
-		result, err := unitool.DeepCollectParams(u.config, from, "params")
+		result, origins, err := unitool.DeepCollectParamsWithOrigins(u.config, from, "params", u.origins)
 		if err != nil {
-			log.Errorf("Error: %v", err)
+			return nil, false, false, false, nil, err
 		}
-		processedFromKeys[from] = result
+		u.processedFromKeys[from], u.processedFromOrigins[from] = result, origins
 		log.Debugf("FromProcess() - processed: %v", from)
-		return result, true, true, true, from
+		return result, true, true, true, from, nil
+	}
+	return nil, false, false, false, nil, nil
+}
+
+// fromCycle returns the chain of "from" references leading back to its first element if there is one.
+func (u *Uniconf) fromCycle(from string, chain []string) []string {
+	params, err := unitool.DeepCollectParams(u.config, from, "params")
+	if err != nil {
+		return nil
+	}
+	var references []interface{}
+	switch value := params[IncludeListElementName].(type) {
+	case string:
+		references = []interface{}{value}
+	case []interface{}:
+		references = value
+	}
+	for _, reference := range references {
+		s, ok := reference.(string)
+		if !ok {
+			continue
+		}
+		if s, err = u.interpolateString(s, u.config, ""); err != nil {
+			continue
+		}
+		if s == chain[0] {
+			return append(chain[:len(chain):len(chain)], s)
+		}
+		if stringListContains(chain, s) {
+			// The cycle doesn't include the checked reference, it is reported when the reference is processed.
+			continue
+		}
+		if cycle := u.fromCycle(s, append(chain[:len(chain):len(chain)], s)); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func InterpolateString(input string, config map[string]interface{}) (string, error) {
+	return u.InterpolateString(input, config)
+}
+
+// InterpolateString interpolates input using config, the instance config is used if config is nil.
+// Secrets are evaluated.
+func (u *Uniconf) InterpolateString(input string, config map[string]interface{}) (string, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	value, err := u.interpolateValue(input, config)
+	if err != nil {
+		return "", err
+	}
+	return interpolatedString(input, value)
+}
+
+func SetUndefinedMode(mode string) error { return u.SetUndefinedMode(mode) }
+
+// SetUndefinedMode sets the mode of undefined references in interpolations: strict, keep or empty.
+func (u *Uniconf) SetUndefinedMode(mode string) error {
+	switch mode {
+	case UndefinedStrict, UndefinedKeep, UndefinedEmpty:
+	default:
+		return fmt.Errorf("unknown undefined references mode: %s", mode)
 	}
-	return nil, false, false, false, nil
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.undefinedMode = mode
+	return nil
+}
+
+func Interpolate(input string, config map[string]interface{}) (interface{}, error) {
+	return u.Interpolate(input, config)
 }
 
-func InterpolateString(input string, config map[string]interface{}) string {
+// Interpolate interpolates input like InterpolateString, but input consisting of exactly one interpolation,
+// e.g. "${params}" or "${deepGet(\"params\")}", results in the referenced value of its original type.
+func (u *Uniconf) Interpolate(input string, config map[string]interface{}) (interface{}, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	value, err := u.interpolateValue(input, config)
+	if err != nil {
+		return nil, err
+	}
+	return unescapeInterpolations(value), nil
+}
+
+// interpolateValue interpolates input evaluating secrets, the instance config with revealed secrets is used
+// if config is nil.
+func (u *Uniconf) interpolateValue(input string, config map[string]interface{}) (interface{}, error) {
 	if config == nil {
-		config = u.flatConfig
+		config = u.config
+		if tree, _, err := parseInterpolation(input); err == nil && dependsOnSecrets(tree, config) {
+			revealed, errs := u.revealed(config)
+			if len(errs) > 0 {
+				return nil, errs
+			}
+			config = revealed
+		}
 	}
-	if strings.Contains(input, "${") {
-		r, _ := regexp.Compile(`(.*\${)(context\.)(.*})`)
-		input = r.ReplaceAllString(input, "$1$3")
+	return u.evaluate(input, config, "", true)
+}
 
-		tree, err := hil.Parse(input)
+// interpolateString interpolates input of the value at the path into the unescaped string.
+func (u *Uniconf) interpolateString(input string, config map[string]interface{}, path string) (string, error) {
+	value, err := u.interpolate(input, config, path)
+	if err != nil {
+		return "", err
+	}
+	return interpolatedString(input, value)
+}
+
+// interpolatedString converts the interpolated value of input into the unescaped string.
+func interpolatedString(input string, value interface{}) (string, error) {
+	switch value := unescapeInterpolations(value).(type) {
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("interpolate %q: result is not a string: %v", input, value)
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(hilInput(value)), nil
+	}
+}
+
+// interpolate interpolates input of the value at the path, interpolations depending on secrets are kept as is.
+func (u *Uniconf) interpolate(input string, config map[string]interface{}, path string) (interface{}, error) {
+	return u.evaluate(input, config, path, false)
+}
+
+// evaluate interpolates input of the value at the path, file() paths are relative to the source of the value.
+// Interpolations depending on secrets are kept as is unless secrets is true.
+// The result is escaped like config values are, literal "${" of the input & of interpolated values is "$${".
+func (u *Uniconf) evaluate(input string, config map[string]interface{}, path string, secrets bool) (interface{}, error) {
+	if !hasInterpolations(input) {
+		return input, nil
+	}
+	tree, parsed, err := parseInterpolation(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(undefinedReferences(tree, config)) > 0 || (!secrets && dependsOnSecrets(tree, config)) {
+		return u.evaluateSegments(input, config, path, func(text string, tree ast.Node) bool {
+			return secrets || !dependsOnSecrets(tree, config)
+		})
+	}
+	input = parsed
+
+	if value, ok := referencedValue(tree, config); ok {
+		return value, nil
+	}
+
+	deepGet := ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString},
+		ReturnType: ast.TypeString,
+		Variadic:   false,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			input := inputs[0].(string)
+			switch value := unitool.SearchMapWithPathStringPrefixes(config, input).(type) {
+			case nil:
+				return "", nil
+			case map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("deepGet: %s is not a scalar value", input)
+			default:
+				return fmt.Sprint(hilInput(unescapeInterpolations(value))), nil
+			}
+		},
+	}
+
+	env := ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString},
+		ReturnType: ast.TypeString,
+		Variadic:   false,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			input := inputs[0].(string)
+			return os.Getenv(input), nil
+		},
+	}
+
+	secret := ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString},
+		ReturnType: ast.TypeString,
+		Variadic:   false,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			return u.secret(inputs[0].(string))
+		},
+	}
+
+	// Only referenced variables are converted, they are looked up by dotted paths. Undefined & null values
+	// are empty strings, they are referenced only by arguments of fallback functions at this point.
+	configMap := map[string]ast.Variable{}
+	for _, reference := range variableReferences(tree) {
+		if value := unitool.SearchMapWithPathStringPrefixes(config, reference); value != nil {
+			variable, err := hil.InterfaceToVariable(hilInput(unescapeInterpolations(unitool.StripDirectives(value))))
+			if err != nil {
+				return nil, fmt.Errorf("interpolate %q: %s: %v", input, reference, err)
+			}
+			configMap[reference] = variable
+		} else {
+			configMap[reference] = ast.Variable{Type: ast.TypeString, Value: ""}
+		}
+	}
+
+	funcMap := u.funcMap(path)
+	funcMap["deepGet"] = deepGet
+	funcMap["env"] = env
+	funcMap["secret"] = secret
+
+	c := &hil.EvalConfig{
+		GlobalScope: &ast.BasicScope{
+			VarMap:  configMap,
+			FuncMap: funcMap,
+		},
+	}
+
+	result, err := hil.Eval(tree, c)
+	if err != nil {
+		return nil, fmt.Errorf("interpolate %q: %v", input, err)
+	}
+	return escapeInterpolations(hilValue(result.Value)), nil
+}
+
+// evaluateSegments evaluates interpolations of input one by one: interpolations are kept as is unless evaluate
+// returns true for them, ones with undefined references are kept or emptied according to the undefined references mode.
+func (u *Uniconf) evaluateSegments(input string, config map[string]interface{}, path string, evaluate func(text string, tree ast.Node) bool) (interface{}, error) {
+	segments := splitInterpolations(input)
+	evaluated := make([]bool, len(segments))
+	undefined := make(map[int]bool)
+	references := make([]string, 0)
+	for i, segment := range segments {
+		if !segment.interpolation {
+			continue
+		}
+		tree, _, err := parseInterpolation(segment.text)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		if !evaluate(segment.text, tree) {
+			continue
 		}
+		for _, reference := range undefinedReferences(tree, config) {
+			undefined[i] = true
+			if !stringListContains(references, reference) {
+				references = append(references, reference)
+			}
+		}
+		evaluated[i] = !undefined[i]
+	}
+	if len(references) > 0 && u.undefinedMode != UndefinedKeep && u.undefinedMode != UndefinedEmpty {
+		sort.Strings(references)
+		return nil, fmt.Errorf("interpolate %q: undefined references: %s", input, strings.Join(references, ", "))
+	}
+	values := make([]interface{}, 0, len(segments))
+	for i, segment := range segments {
+		switch {
+		case evaluated[i]:
+			value, err := u.evaluate(segment.text, config, path, true)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		case undefined[i] && u.undefinedMode == UndefinedEmpty:
+			values = append(values, "")
+		default:
+			values = append(values, segment.text)
+		}
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	result := ""
+	for _, value := range values {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("interpolate %q: result is not a string: %v", input, value)
+		}
+		result += fmt.Sprint(value)
+	}
+	return result, nil
+}
 
-		deepGet := ast.Function{
-			ArgTypes:   []ast.Type{ast.TypeString},
-			ReturnType: ast.TypeString,
-			Variadic:   false,
-			Callback: func(inputs []interface{}) (interface{}, error) {
-				input := inputs[0].(string)
-				return unitool.SearchMapWithPathStringPrefixes(config, input), nil
-			},
+// undefinedReferences returns sorted key paths referenced in the tree which are not defined in config or are null,
+// except for arguments of fallback functions.
+func undefinedReferences(tree ast.Node, config map[string]interface{}) []string {
+	undefined := make([]string, 0)
+	for _, reference := range requiredReferences(tree) {
+		if unitool.SearchMapWithPathStringPrefixes(config, reference) == nil && !stringListContains(undefined, reference) {
+			undefined = append(undefined, reference)
 		}
+	}
+	sort.Strings(undefined)
+	return undefined
+}
+
+// segment is the literal text or the "${...}" interpolation of the input.
+type segment struct {
+	text          string
+	interpolation bool
+}
 
-		env := ast.Function{
-			ArgTypes:   []ast.Type{ast.TypeString},
-			ReturnType: ast.TypeString,
-			Variadic:   false,
-			Callback: func(inputs []interface{}) (interface{}, error) {
-				input := inputs[0].(string)
-				return os.Getenv(input), nil
-			},
+// splitInterpolations splits input into literal text & interpolations, "$${" escapes are kept in literal text.
+func splitInterpolations(input string) []segment {
+	segments := make([]segment, 0)
+	var literal strings.Builder
+	for i := 0; i < len(input); {
+		switch {
+		case strings.HasPrefix(input[i:], "$${"):
+			literal.WriteString("$${")
+			i += 3
+		case strings.HasPrefix(input[i:], "${"):
+			end, depth := i+2, 1
+			for ; end < len(input) && depth > 0; end++ {
+				if strings.HasPrefix(input[end:], "${") {
+					depth++
+					end++
+				} else if input[end] == '}' {
+					depth--
+				}
+			}
+			if literal.Len() > 0 {
+				segments = append(segments, segment{text: literal.String()})
+				literal.Reset()
+			}
+			segments = append(segments, segment{text: input[i:end], interpolation: true})
+			i = end
+		default:
+			literal.WriteByte(input[i])
+			i++
 		}
+	}
+	if literal.Len() > 0 {
+		segments = append(segments, segment{text: literal.String()})
+	}
+	return segments
+}
 
-		configMap := map[string]ast.Variable{}
-		for k, v := range config {
-			configMap[k], _ = hil.InterfaceToVariable(v)
+// hasInterpolations returns true if input contains interpolations which aren't escaped.
+func hasInterpolations(input string) bool {
+	for _, segment := range splitInterpolations(input) {
+		if segment.interpolation {
+			return true
 		}
+	}
+	return false
+}
+
+var (
+	interpolationEscaper   = strings.NewReplacer("${", "$${")
+	interpolationUnescaper = strings.NewReplacer("$${", "${")
+)
+
+// escapeInterpolations escapes "${" in strings of the interpolated value, so it is literal in config.
+func escapeInterpolations(value interface{}) interface{} {
+	return unitool.ReplaceStrings(value, interpolationEscaper.Replace)
+}
+
+// unescapeInterpolations unescapes "$${" in strings of the config value, e.g. for output.
+func unescapeInterpolations(value interface{}) interface{} {
+	return unitool.ReplaceStrings(value, interpolationUnescaper.Replace)
+}
 
-		c := &hil.EvalConfig{
-			GlobalScope: &ast.BasicScope{
-				VarMap: configMap,
-				FuncMap: map[string]ast.Function{
-					"deepGet": deepGet,
-					"env":     env,
-				},
-			},
+// referencedValue returns the copy of the value referenced by the only interpolation of the tree,
+// e.g. "${params}" or "${deepGet(\"params\")}".
+func referencedValue(tree ast.Node, config map[string]interface{}) (interface{}, bool) {
+	output, ok := tree.(*ast.Output)
+	if !ok || len(output.Exprs) != 1 {
+		return nil, false
+	}
+	key := ""
+	switch node := output.Exprs[0].(type) {
+	case *ast.VariableAccess:
+		key = node.Name
+	case *ast.Call:
+		if node.Func != "deepGet" || len(node.Args) != 1 {
+			return nil, false
 		}
+		literal, ok := node.Args[0].(*ast.LiteralNode)
+		if !ok || literal.Typex != ast.TypeString {
+			return nil, false
+		}
+		key = literal.Value.(string)
+	default:
+		return nil, false
+	}
+	value := unitool.SearchMapWithPathStringPrefixes(config, key)
+	if value == nil {
+		return nil, false
+	}
+	copied, err := unitool.DeepCopyMap(map[string]interface{}{"value": unitool.StripDirectives(value)})
+	if err != nil {
+		return nil, false
+	}
+	return copied["value"], true
+}
 
-		result, err := hil.Eval(tree, c)
-		if err != nil {
-			log.Fatal(err)
+var contextReferenceRe = regexp.MustCompile(`(.*\${)(context\.)(.*})`)
+
+// parseInterpolation parses input, references to context values are references to config values.
+func parseInterpolation(input string) (ast.Node, string, error) {
+	input = contextReferenceRe.ReplaceAllString(input, "$1$3")
+	tree, err := hil.Parse(input)
+	if err != nil {
+		return nil, input, fmt.Errorf("parse %q: %v", input, err)
+	}
+	return tree, input, nil
+}
+
+// variableReferences returns names of variables accessed in the tree.
+func variableReferences(tree ast.Node) []string {
+	references := make([]string, 0)
+	tree.Accept(func(node ast.Node) ast.Node {
+		if v, ok := node.(*ast.VariableAccess); ok {
+			references = append(references, v.Name)
 		}
+		return node
+	})
+	return references
+}
 
-		//fmt.Printf("Type: %s\n", result.Type)
-		//fmt.Printf("Value: %s\n", result.Value)
+// fallbackFunctions return their last arguments if previous ones are empty, the previous ones may be undefined.
+var fallbackFunctions = []string{"default", "coalesce"}
 
-		return result.Value.(string)
+// requiredReferences returns key paths referenced in the tree like keyReferences,
+// but without references in arguments of fallback functions preceding fallbacks.
+func requiredReferences(tree ast.Node) []string {
+	references := make([]string, 0)
+	var walk func(node ast.Node)
+	walk = func(node ast.Node) {
+		switch n := node.(type) {
+		case *ast.VariableAccess:
+			references = append(references, n.Name)
+		case *ast.Call:
+			args := n.Args
+			if stringListContains(fallbackFunctions, n.Func) && len(args) > 0 {
+				args = args[len(args)-1:]
+			}
+			if n.Func == "deepGet" && len(args) == 1 {
+				if literal, ok := args[0].(*ast.LiteralNode); ok && literal.Typex == ast.TypeString {
+					references = append(references, strings.Trim(literal.Value.(string), "."))
+				}
+			}
+			for _, arg := range args {
+				walk(arg)
+			}
+		case *ast.Output:
+			for _, expr := range n.Exprs {
+				walk(expr)
+			}
+		case *ast.Arithmetic:
+			for _, expr := range n.Exprs {
+				walk(expr)
+			}
+		case *ast.Index:
+			walk(n.Target)
+			walk(n.Key)
+		case *ast.Conditional:
+			walk(n.CondExpr)
+			walk(n.TrueExpr)
+			walk(n.FalseExpr)
+		}
 	}
+	walk(tree)
+	return references
+}
 
-	return input
+// keyReferences returns key paths referenced in the tree by variables & deepGet calls with literal keys.
+func keyReferences(tree ast.Node) []string {
+	references := variableReferences(tree)
+	tree.Accept(func(node ast.Node) ast.Node {
+		if call, ok := node.(*ast.Call); ok && call.Func == "deepGet" && len(call.Args) == 1 {
+			if literal, ok := call.Args[0].(*ast.LiteralNode); ok && literal.Typex == ast.TypeString {
+				references = append(references, strings.Trim(literal.Value.(string), "."))
+			}
+		}
+		return node
+	})
+	return references
 }
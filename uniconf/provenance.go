@@ -0,0 +1,88 @@
+package uniconf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aroq/uniconf/unitool"
+)
+
+// Provenance describes where the leaf config value came from.
+type Provenance struct {
+	Path  string
+	Value interface{}
+	// Origins lists all definitions of the value in order of overriding, the last one is effective.
+	Origins []unitool.Origin
+}
+
+func Explain(path string) ([]*Provenance, error) { return u.Explain(path) }
+
+// Explain returns provenance of leaf values of the config by the dotted path, e.g. "jobs.install",
+// the whole config is explained if the path is empty.
+func (u *Uniconf) Explain(path string) ([]*Provenance, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.outputConfig()
+	if err != nil {
+		return nil, err
+	}
+	var value interface{} = config
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				var ok bool
+				if value, ok = v[key]; !ok {
+					return nil, fmt.Errorf("key %s is not found", path)
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(v) {
+					return nil, fmt.Errorf("key %s is not found", path)
+				}
+				value = v[i]
+			default:
+				return nil, fmt.Errorf("key %s is not found", path)
+			}
+		}
+	}
+	result := make([]*Provenance, 0)
+	unitool.WalkLeaves(value, path, func(p string, v interface{}) {
+		result = append(result, &Provenance{Path: p, Value: v, Origins: u.origins[p]})
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// originString returns the origin as "source:entity file:line:column", unknown parts are omitted.
+func originString(o unitool.Origin) string {
+	location := o.File
+	if o.Line > 0 {
+		if location != "" {
+			location += ":"
+		}
+		location += fmt.Sprintf("%d:%d", o.Line, o.Column)
+	}
+	if location == "" {
+		return o.Source + ":" + o.EntityID
+	}
+	return o.Source + ":" + o.EntityID + " " + location
+}
+
+// String returns the value with its origins, the effective one is the last.
+func (p *Provenance) String() string {
+	lines := []string{fmt.Sprintf("%s = %v", p.Path, p.Value)}
+	if len(p.Origins) == 0 {
+		lines = append(lines, "  <unknown origin>")
+	}
+	for i, o := range p.Origins {
+		prefix := "  overridden by "
+		if i == 0 {
+			prefix = "  defined in "
+		}
+		lines = append(lines, prefix+originString(o))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,182 @@
+package uniconf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aroq/uniconf/unitool"
+	"github.com/hashicorp/hil/ast"
+)
+
+func Resolve(inputs []interface{}) (interface{}, error) { return u.Resolve(inputs) }
+
+// Resolve replaces interpolations of config values with their results, values referencing other interpolated values
+// are resolved after them. The optional input is the key path of the subtree to resolve, values outside of it are
+// resolved only if the subtree references them. Reference cycles are reported with key paths of values involved.
+func (u *Uniconf) Resolve(inputs []interface{}) (interface{}, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	path := ""
+	if len(inputs) > 0 {
+		path, _ = inputs[0].(string)
+	}
+	if errs := u.resolve(strings.Trim(path, ".")); len(errs) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
+
+// interpolation is the config value containing interpolations.
+type interpolation struct {
+	path       string
+	input      string
+	references []string
+	set        func(value interface{})
+	// secrets is the set of interpolations of the input depending on secrets.
+	secrets map[string]bool
+}
+
+// resolve resolves interpolations of the config subtree at the path.
+func (u *Uniconf) resolve(path string) Errors {
+	return u.resolveConfig(u.config, path, false)
+}
+
+// resolveConfig resolves interpolations of the subtree at the path in topological order of their references.
+// Interpolations depending on secrets are kept as is, unless secrets are revealed: only they are resolved then.
+func (u *Uniconf) resolveConfig(config map[string]interface{}, path string, reveal bool) Errors {
+	errs := make(Errors, 0)
+	interpolations := make(map[string]*interpolation)
+	collectInterpolations(config, "", nil, func(i *interpolation, err error) {
+		if err != nil {
+			errs = append(errs, u.resolveError(i.path, err))
+			return
+		}
+		if reveal {
+			// Secrets are looked up before values they depend on are revealed.
+			if i.secrets = secretSegments(i.input, config); len(i.secrets) == 0 {
+				return
+			}
+		}
+		interpolations[i.path] = i
+	})
+	paths := make([]string, 0, len(interpolations))
+	for p := range interpolations {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	failed := make(map[string]bool)
+	stack := make([]string, 0)
+	var visit func(i *interpolation) bool
+	visit = func(i *interpolation) bool {
+		switch state[i.path] {
+		case visited:
+			return !failed[i.path]
+		case visiting:
+			start := len(stack) - 1
+			for stack[start] != i.path {
+				start--
+			}
+			chain := append(append([]string{}, stack[start:]...), i.path)
+			errs = append(errs, u.resolveError(i.path, fmt.Errorf("interpolation cycle: %s", strings.Join(chain, " -> "))))
+			for _, p := range stack[start:] {
+				failed[p] = true
+			}
+			return false
+		}
+		state[i.path] = visiting
+		stack = append(stack, i.path)
+		ok := true
+		for _, dependency := range dependencies(i, paths) {
+			if !visit(interpolations[dependency]) {
+				ok = false
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i.path] = visited
+		if !ok || failed[i.path] {
+			// Values depending on unresolved ones are left as is, the cause is already reported.
+			failed[i.path] = true
+			return false
+		}
+		var value interface{}
+		var err error
+		if reveal {
+			value, err = u.evaluateSegments(i.input, config, i.path, func(text string, tree ast.Node) bool { return i.secrets[text] })
+		} else {
+			value, err = u.interpolate(i.input, config, i.path)
+		}
+		if err != nil {
+			errs = append(errs, u.resolveError(i.path, err))
+			failed[i.path] = true
+			return false
+		}
+		i.set(value)
+		return true
+	}
+	for _, p := range paths {
+		if path == "" || p == path || strings.HasPrefix(p, path+".") {
+			visit(interpolations[p])
+		}
+	}
+	return errs
+}
+
+// resolveError returns the error of the value at the path with the source & entity which set it.
+func (u *Uniconf) resolveError(path string, err error) *Error {
+	e := &Error{Path: path, Err: err}
+	if origin, ok := u.originOf(path); ok {
+		e.Source, e.EntityID = origin.Source, origin.EntityID
+	}
+	return e
+}
+
+// collectInterpolations calls fn for each string value containing interpolations.
+func collectInterpolations(value interface{}, path string, set func(value interface{}), fn func(i *interpolation, err error)) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			k := k
+			collectInterpolations(item, unitool.JoinPath(path, k), func(value interface{}) { v[k] = value }, fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			i := i
+			collectInterpolations(item, unitool.JoinPath(path, strconv.Itoa(i)), func(value interface{}) { v[i] = value }, fn)
+		}
+	case string:
+		if !hasInterpolations(v) {
+			return
+		}
+		i := &interpolation{path: path, input: v, set: set}
+		tree, _, err := parseInterpolation(v)
+		if err != nil {
+			fn(i, err)
+			return
+		}
+		i.references = keyReferences(tree)
+		fn(i, nil)
+	}
+}
+
+// dependencies returns sorted paths of interpolated values the interpolation references,
+// i.e. values at referenced paths, nested in referenced values or containing them.
+func dependencies(i *interpolation, paths []string) []string {
+	result := make([]string, 0)
+	for _, p := range paths {
+		for _, reference := range i.references {
+			if p == reference || strings.HasPrefix(p, reference+".") || strings.HasPrefix(reference, p+".") {
+				result = append(result, p)
+				break
+			}
+		}
+	}
+	return result
+}
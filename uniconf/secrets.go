@@ -0,0 +1,427 @@
+package uniconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/aroq/uniconf/unitool"
+	"github.com/hashicorp/hil/ast"
+)
+
+// SecretsElementName is the config key declaring secret stores, e.g. "secrets: {prod: {type: sops, path: prod.enc.yaml}}".
+const SecretsElementName = "secrets"
+
+// DefaultSecretStore is the store of secret references without store names, e.g. secret("db/prod#password").
+// If it is not declared the only declared store is used.
+const DefaultSecretStore = "default"
+
+// RedactedSecret replaces interpolations depending on secrets in output unless secrets are revealed.
+const RedactedSecret = "[REDACTED]"
+
+// SecretStore resolves secrets referenced as "store:path#field" by the secret interpolation function.
+type SecretStore interface {
+	// Secret returns the secret by its path & optional field, e.g. "db/prod" & "password".
+	Secret(path, field string) (string, error)
+}
+
+// SecretStoreFactory creates a secret store from its spec declared in the "secrets" config key.
+type SecretStoreFactory func(name string, spec map[string]interface{}) (SecretStore, error)
+
+var (
+	secretStoreTypes   = make(map[string]SecretStoreFactory)
+	secretStoreTypesMu sync.RWMutex
+)
+
+func init() {
+	RegisterSecretStoreType("file", newSecretStoreFileFromSpec)
+	RegisterSecretStoreType("env", newSecretStoreEnvFromSpec)
+	RegisterSecretStoreType("sops", newSecretStoreSopsFromSpec)
+}
+
+// RegisterSecretStoreType registers the factory creating secret stores of the type, existing factory is replaced.
+func RegisterSecretStoreType(name string, factory SecretStoreFactory) {
+	secretStoreTypesMu.Lock()
+	defer secretStoreTypesMu.Unlock()
+	secretStoreTypes[name] = factory
+}
+
+func AddSecretStore(name string, store SecretStore) { u.AddSecretStore(name, store) }
+
+// AddSecretStore adds the secret store, it takes precedence over the store of the same name declared in config.
+func (u *Uniconf) AddSecretStore(name string, store SecretStore) {
+	u.secretsMu.Lock()
+	defer u.secretsMu.Unlock()
+	u.secretStores[name] = store
+}
+
+func SetRevealSecrets(reveal bool) { u.SetRevealSecrets(reveal) }
+
+// SetRevealSecrets disables redaction of secrets in output & logs.
+func (u *Uniconf) SetRevealSecrets(reveal bool) {
+	u.secretsMu.Lock()
+	defer u.secretsMu.Unlock()
+	u.revealSecrets = reveal
+}
+
+// secret resolves the secret reference, it is called while the instance is locked.
+func (u *Uniconf) secret(reference string) (string, error) {
+	name, path := "", reference
+	if i := strings.Index(reference, ":"); i >= 0 {
+		name, path = reference[:i], reference[i+1:]
+	}
+	field := ""
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		path, field = path[:i], path[i+1:]
+	}
+	store, err := u.secretStore(name)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", reference, err)
+	}
+	value, err := store.Secret(path, field)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", reference, err)
+	}
+	return value, nil
+}
+
+// Secrets aren't stored in config: interpolations depending on secrets, i.e. calling the secret function or
+// referencing values which depend on secrets, are kept as is when config values are interpolated. They are evaluated
+// in copies of config returned by Config & Unmarshal, and in output if secrets are revealed, or redacted otherwise.
+
+// dependsOnSecrets returns true if the tree calls the secret function or references config values depending on secrets.
+func dependsOnSecrets(tree ast.Node, config map[string]interface{}) bool {
+	return treeDependsOnSecrets(tree, config, make(map[string]bool))
+}
+
+// treeDependsOnSecrets is dependsOnSecrets skipping values at visited key paths.
+func treeDependsOnSecrets(tree ast.Node, config map[string]interface{}, visited map[string]bool) bool {
+	secret := false
+	tree.Accept(func(node ast.Node) ast.Node {
+		if call, ok := node.(*ast.Call); ok && call.Func == "secret" {
+			secret = true
+		}
+		return node
+	})
+	if secret {
+		return true
+	}
+	for _, reference := range keyReferences(tree) {
+		if visited[reference] {
+			continue
+		}
+		visited[reference] = true
+		if valueDependsOnSecrets(unitool.SearchMapWithPathStringPrefixes(config, reference), config, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// valueDependsOnSecrets returns true if strings of the value contain interpolations depending on secrets.
+func valueDependsOnSecrets(value interface{}, config map[string]interface{}, visited map[string]bool) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if valueDependsOnSecrets(item, config, visited) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if valueDependsOnSecrets(item, config, visited) {
+				return true
+			}
+		}
+	case string:
+		for _, segment := range splitInterpolations(v) {
+			if !segment.interpolation {
+				continue
+			}
+			if tree, _, err := parseInterpolation(segment.text); err == nil && treeDependsOnSecrets(tree, config, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revealed returns the copy of config with interpolations depending on secrets evaluated,
+// config is returned as is if it doesn't depend on secrets.
+func (u *Uniconf) revealed(config map[string]interface{}) (map[string]interface{}, Errors) {
+	if !valueDependsOnSecrets(config, config, make(map[string]bool)) {
+		return config, nil
+	}
+	copied := unitool.CopyValue(config).(map[string]interface{})
+	if errs := u.resolveConfig(copied, "", true); len(errs) > 0 {
+		return nil, errs
+	}
+	return copied, nil
+}
+
+// secretSegments returns the set of interpolations of input depending on secrets.
+func secretSegments(input string, config map[string]interface{}) map[string]bool {
+	segments := make(map[string]bool)
+	for _, segment := range splitInterpolations(input) {
+		if !segment.interpolation {
+			continue
+		}
+		if tree, _, err := parseInterpolation(segment.text); err == nil && dependsOnSecrets(tree, config) {
+			segments[segment.text] = true
+		}
+	}
+	return segments
+}
+
+// redacted returns the value with interpolations depending on secrets replaced by RedactedSecret,
+// their dependencies are looked up in config.
+func redacted(value interface{}, config map[string]interface{}) interface{} {
+	return unitool.ReplaceStrings(value, func(s string) string {
+		if !hasInterpolations(s) {
+			return s
+		}
+		secrets := secretSegments(s, config)
+		var result strings.Builder
+		for _, segment := range splitInterpolations(s) {
+			if segment.interpolation && secrets[segment.text] {
+				segment.text = RedactedSecret
+			}
+			result.WriteString(segment.text)
+		}
+		return result.String()
+	})
+}
+
+// outputConfig returns config for output: without directives, with secrets revealed or redacted
+// & with unescaped interpolations.
+func (u *Uniconf) outputConfig() (map[string]interface{}, error) {
+	u.secretsMu.RLock()
+	reveal := u.revealSecrets
+	u.secretsMu.RUnlock()
+	if reveal {
+		return u.revealedConfig()
+	}
+	config := unitool.StripDirectives(u.config).(map[string]interface{})
+	return unescapeInterpolations(redacted(config, config)).(map[string]interface{}), nil
+}
+
+// loggedValue returns the interpolated value of input for logs, it is redacted if input depends on secrets
+// which are not revealed.
+func (u *Uniconf) loggedValue(input string, value interface{}) interface{} {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	u.secretsMu.RLock()
+	reveal := u.revealSecrets
+	u.secretsMu.RUnlock()
+	if !reveal && valueDependsOnSecrets(input, u.config, make(map[string]bool)) {
+		return RedactedSecret
+	}
+	return value
+}
+
+// revealedConfig returns config without directives, with revealed secrets & unescaped interpolations.
+func (u *Uniconf) revealedConfig() (map[string]interface{}, error) {
+	config, errs := u.revealed(unitool.StripDirectives(u.config).(map[string]interface{}))
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return unescapeInterpolations(config).(map[string]interface{}), nil
+}
+
+// secretStore returns the store added by AddSecretStore or creates the one declared in config.
+func (u *Uniconf) secretStore(name string) (SecretStore, error) {
+	specs, _ := u.config[SecretsElementName].(map[string]interface{})
+	u.secretsMu.Lock()
+	defer u.secretsMu.Unlock()
+	if name == "" {
+		name = DefaultSecretStore
+		if _, ok := u.secretStores[name]; !ok && specs[name] == nil && len(specs) == 1 {
+			for k := range specs {
+				name = k
+			}
+		}
+	}
+	if store, ok := u.secretStores[name]; ok {
+		return store, nil
+	}
+	spec, ok := specs[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("secret store %s is not declared", name)
+	}
+	storeType, _ := spec["type"].(string)
+	secretStoreTypesMu.RLock()
+	factory, ok := secretStoreTypes[storeType]
+	secretStoreTypesMu.RUnlock()
+	if !ok {
+		return nil, &Error{Path: SecretsElementName + "." + name + ".type", Err: fmt.Errorf("unknown secret store type: %s", storeType)}
+	}
+	store, err := factory(name, spec)
+	if err != nil {
+		return nil, &Error{Path: SecretsElementName + "." + name, Err: err}
+	}
+	u.secretStores[name] = store
+	return store, nil
+}
+
+// SecretStoreFile reads secrets from files of the directory, e.g. "db/prod#password" is the "password" key
+// of the "db/prod.yaml" file, the whole trimmed content of the file is the secret if the field is empty.
+type SecretStoreFile struct {
+	Path string
+}
+
+func newSecretStoreFileFromSpec(name string, spec map[string]interface{}) (SecretStore, error) {
+	path, err := specString(spec, "path", true)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStoreFile{Path: path}, nil
+}
+
+// Secret returns the secret from the file.
+func (s *SecretStoreFile) Secret(path, field string) (string, error) {
+	filename := filepath.Join(s.Path, filepath.FromSlash(path))
+	if rel, err := filepath.Rel(s.Path, filename); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("path %s is outside of the store", path)
+	}
+	for _, name := range []string{filename, filename + ".yaml", filename + ".yml", filename + ".json"} {
+		stream, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if field == "" {
+			return strings.TrimSpace(string(stream)), nil
+		}
+		format := unitool.FormatByExtension(name)
+		if format == "" {
+			format = "yaml"
+		}
+		secrets, err := unitool.UnmarshalByType(format, stream)
+		if err != nil {
+			return "", err
+		}
+		return secretField(secrets, field)
+	}
+	return "", fmt.Errorf("secret file %s is not found", path)
+}
+
+// SecretStoreEnv reads secrets from environment variables, e.g. "db/prod#password" is DB_PROD_PASSWORD
+// prefixed by the optional prefix.
+type SecretStoreEnv struct {
+	Prefix string
+}
+
+func newSecretStoreEnvFromSpec(name string, spec map[string]interface{}) (SecretStore, error) {
+	prefix, err := specString(spec, "prefix", false)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStoreEnv{Prefix: prefix}, nil
+}
+
+var envNameRe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// Secret returns the secret from the environment variable.
+func (s *SecretStoreEnv) Secret(path, field string) (string, error) {
+	name := path
+	if field != "" {
+		name += "_" + field
+	}
+	name = s.Prefix + envNameRe.ReplaceAllString(strings.ToUpper(name), "_")
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// SecretStoreSops reads secrets from the SOPS file encrypted for age recipients, e.g. "db/prod#password"
+// is the "db.prod.password" key. Age identities are read from the key file of the spec, SOPS_AGE_KEY
+// or SOPS_AGE_KEY_FILE environment variables.
+type SecretStoreSops struct {
+	Path    string
+	KeyFile string
+
+	once    sync.Once
+	secrets map[string]interface{}
+	err     error
+}
+
+func newSecretStoreSopsFromSpec(name string, spec map[string]interface{}) (SecretStore, error) {
+	path, err := specString(spec, "path", true)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := specString(spec, "key_file", false)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStoreSops{Path: path, KeyFile: keyFile}, nil
+}
+
+// Secret returns the secret from the decrypted file, the file is decrypted once.
+func (s *SecretStoreSops) Secret(path, field string) (string, error) {
+	s.once.Do(func() {
+		s.secrets, s.err = s.decrypt()
+	})
+	if s.err != nil {
+		return "", s.err
+	}
+	key := strings.Replace(strings.Trim(path, "/"), "/", ".", -1)
+	if field != "" {
+		key = unitool.JoinPath(key, field)
+	}
+	return secretField(s.secrets, key)
+}
+
+func (s *SecretStoreSops) decrypt() (map[string]interface{}, error) {
+	identities := make([]age.Identity, 0)
+	keys := make([]string, 0)
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		keys = append(keys, key)
+	}
+	for _, keyFile := range []string{s.KeyFile, os.Getenv("SOPS_AGE_KEY_FILE")} {
+		if keyFile == "" {
+			continue
+		}
+		stream, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(stream))
+	}
+	for _, key := range keys {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, parsed...)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("age identities are not found")
+	}
+	stream, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return unitool.DecryptSops(stream, identities)
+}
+
+// secretField returns the scalar value by the dotted key path.
+func secretField(secrets map[string]interface{}, field string) (string, error) {
+	value := unitool.SearchMapWithPathStringPrefixes(secrets, field)
+	switch value.(type) {
+	case nil:
+		return "", fmt.Errorf("field %s is not found", field)
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("field %s is not a scalar value", field)
+	}
+	return fmt.Sprint(value), nil
+}
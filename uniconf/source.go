@@ -1,14 +1,21 @@
 package uniconf
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/aroq/uniconf/unitool"
 	"github.com/hashicorp/go-getter"
+	"github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
 type SourceHandler interface {
@@ -20,6 +27,8 @@ type SourceHandler interface {
 	GetIncludeConfigEntityIds(scenarioID string) ([]string, error)
 	LoadConfigEntity(configMap map[string]interface{}) (*ConfigEntity, error)
 	ConfigEntity(id string) (*ConfigEntity, bool)
+	Uniconf() *Uniconf
+	SetUniconf(u *Uniconf)
 }
 
 type Source struct {
@@ -29,16 +38,22 @@ type Source struct {
 	isLoaded       bool
 	configEntities map[string]*ConfigEntity
 	autoloadID     string
+	uniconf        *Uniconf
 }
 
 type SourceFile struct {
 	Source
 	path string
+	// checksums holds checksums of loaded files by paths relative to the source path.
+	checksums map[string]interface{}
 }
 
 type SourceGoGetter struct {
 	SourceFile
-	url string
+	url      string
+	checksum string
+	// ttl is the time the cached copy is used without fetching it again.
+	ttl time.Duration
 }
 
 type SourceRepo struct {
@@ -46,6 +61,18 @@ type SourceRepo struct {
 	repo      string
 	ref       string
 	refPrefix string
+	commit    string
+	subpath   string
+	auth      map[string]interface{}
+	// ttl is the time the cached copy is used without fetching it again.
+	ttl time.Duration
+	// resolvedCommit is the hash of the checked out commit.
+	resolvedCommit string
+}
+
+// SourceMetadataProvider is implemented by sources providing metadata of the loaded source, e.g. resolved commit.
+type SourceMetadataProvider interface {
+	Metadata() map[string]interface{}
 }
 
 type SourceEnv struct {
@@ -60,7 +87,7 @@ type SourceConfigMap struct {
 const (
 	refPrefix     = "refs/"
 	refHeadPrefix = refPrefix + "heads/"
-	//refTagPrefix    = refPrefix + "tags/"
+	refTagPrefix  = refPrefix + "tags/"
 )
 
 func (s *Source) Name() string {
@@ -88,6 +115,16 @@ func (s *Source) Autoload() string {
 	return s.autoloadID
 }
 
+// Uniconf returns the instance the source is registered in.
+func (s *Source) Uniconf() *Uniconf {
+	return s.uniconf
+}
+
+// SetUniconf binds the source to the instance.
+func (s *Source) SetUniconf(u *Uniconf) {
+	s.uniconf = u
+}
+
 func (s *Source) LoadConfigEntity(configMap map[string]interface{}) (*ConfigEntity, error) {
 	//fmt.Println("Process %s: %s", configMap["name"], configMap["id"])
 	if c, ok := s.ConfigEntity(configMap["id"].(string)); ok {
@@ -96,10 +133,21 @@ func (s *Source) LoadConfigEntity(configMap map[string]interface{}) (*ConfigEnti
 
 	c, err := NewConfigEntity(s, configMap)
 	if err != nil {
-		log.Fatalf("Error creating ConfigEntity: %v", err)
+		return nil, &Error{Source: s.name, EntityID: configMap["id"].(string), Err: err}
 	}
 	s.configEntities[c.id] = c
-	c.process()
+	if err := c.process(); err != nil {
+		errs := toErrors(err)
+		for _, e := range errs {
+			if e.Source == "" {
+				e.Source, e.EntityID = s.name, c.id
+			}
+		}
+		if len(errs) == 1 {
+			return nil, errs[0]
+		}
+		return nil, errs
+	}
 	return c, nil
 }
 
@@ -116,21 +164,131 @@ func (s *SourceFile) Path() string {
 }
 
 func (s *SourceGoGetter) LoadSource() error {
-	err := getter.GetAny(s.path, s.url)
-	if err == nil {
-		err = s.Source.LoadSource()
+	dir, _, err := s.uniconf.cachedSource(s.url, s.ttl, false, func(dir string) (string, error) {
+		return "", getter.GetAny(dir, s.url)
+	})
+	if err != nil {
+		return err
+	}
+	s.path = dir
+	if s.checksum, err = dirChecksum(dir); err != nil {
+		return err
+	}
+	return s.Source.LoadSource()
+}
+
+// LockEntry returns the url & the checksum of the downloaded files.
+func (s *SourceGoGetter) LockEntry() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "go-getter",
+		"url":      s.url,
+		"checksum": s.checksum,
 	}
-	return err
 }
 
 func (s *SourceRepo) LoadSource() error {
-	err := unitool.GitClone(s.repo, s.refPrefix+s.ref, s.path, 1, true)
+	auth, err := gitAuthMethod(s.auth)
+	if err != nil {
+		return err
+	}
+	referenceName := ""
+	if s.ref != "" {
+		referenceName = s.refPrefix + s.ref
+	}
+	key := strings.Join([]string{s.repo, referenceName, s.commit, s.subpath}, "#")
+	dir, meta, err := s.uniconf.cachedSource(key, s.ttl, s.commit != "", func(dir string) (string, error) {
+		return unitool.GitCheckout(unitool.GitOptions{
+			URL:           s.repo,
+			ReferenceName: referenceName,
+			Commit:        s.commit,
+			Subpath:       s.subpath,
+			Path:          dir,
+			Auth:          auth,
+		})
+	})
 	if err == nil {
+		s.path, s.resolvedCommit = dir, meta.Commit
 		err = s.Source.LoadSource()
 	}
 	return err
 }
 
+// Metadata returns the repository & the resolved commit.
+func (s *SourceRepo) Metadata() map[string]interface{} {
+	metadata := map[string]interface{}{
+		"type":   "repo",
+		"repo":   s.repo,
+		"commit": s.resolvedCommit,
+	}
+	if s.ref != "" {
+		metadata["ref"] = s.refPrefix + s.ref
+	}
+	if s.subpath != "" {
+		metadata["subpath"] = s.subpath
+	}
+	return metadata
+}
+
+// LockEntry returns the repository & the resolved commit.
+func (s *SourceRepo) LockEntry() map[string]interface{} {
+	return s.Metadata()
+}
+
+// LockEntry returns checksums of loaded files.
+func (s *SourceFile) LockEntry() map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "file",
+		"files": s.checksums,
+	}
+}
+
+// gitAuthMethod returns the auth method using credentials from environment variables or files.
+func gitAuthMethod(auth map[string]interface{}) (transport.AuthMethod, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	secret := func(envKey, fileKey string) ([]byte, error) {
+		if name, ok := auth[envKey].(string); ok {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return nil, fmt.Errorf("auth environment variable %q is not set", name)
+			}
+			return []byte(value), nil
+		}
+		if file, ok := auth[fileKey].(string); ok {
+			file, err := homedir.Expand(file)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadFile(file)
+		}
+		return nil, nil
+	}
+	user, ok := auth["user"].(string)
+	if !ok {
+		user = "git"
+	}
+	switch auth["type"] {
+	case "ssh":
+		key, err := secret("key_env", "key_file")
+		if err != nil {
+			return nil, err
+		}
+		passphrase, err := secret("passphrase_env", "passphrase_file")
+		if err != nil {
+			return nil, err
+		}
+		return gitssh.NewPublicKeys(user, key, strings.TrimSpace(string(passphrase)))
+	case "token":
+		token, err := secret("token_env", "token_file")
+		if err != nil {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: user, Password: strings.TrimSpace(string(token))}, nil
+	}
+	return nil, fmt.Errorf("unknown auth type: %v", auth["type"])
+}
+
 func (s *SourceFile) GetIncludeConfigEntityIds(id string) ([]string, error) {
 	ids := make([]string, 0)
 	files := make([]string, 0)
@@ -150,30 +308,30 @@ func (s *SourceFile) GetIncludeConfigEntityIds(id string) ([]string, error) {
 
 func (s *SourceFile) LoadConfigEntity(configMap map[string]interface{}) (*ConfigEntity, error) {
 	//fmt.Printf("Process %s: %s", configMap["name"], configMap["id"])
-	if _, ok := s.ConfigEntity(configMap["id"].(string)); !ok {
-		if scenarioID, ok := configMap["id"].(string); ok {
-			stream := unitool.ReadFile(scenarioID)
-			configMap["stream"] = stream
-			if _, ok := configMap["format"]; !ok {
-				configMap["format"] = unitool.FormatByExtension(scenarioID)
-			}
-			conf, err := unitool.UnmarshalByType(configMap["format"].(string), stream)
-			if err == nil {
-				configMap["config"] = conf
-				if configEntity, err := s.Source.LoadConfigEntity(configMap); err == nil {
-					return configEntity, nil
-				}
-				log.Warnf("LoadConfigEntity error: %v", err)
-			} else {
-				log.Errorf("UnmarshalByType error: %v", err)
-			}
-		} else {
-			log.Errorf("config map doesn't contain id")
-		}
-	} else {
-		return nil, fmt.Errorf("config entity already loaded: %s", configMap["id"].(string))
+	scenarioID, ok := configMap["id"].(string)
+	if !ok {
+		return nil, &Error{Source: s.name, Err: errors.New("config map doesn't contain id")}
+	}
+	if _, ok := s.ConfigEntity(scenarioID); ok {
+		return nil, &alreadyLoadedError{id: scenarioID}
+	}
+	stream, err := unitool.ReadFile(scenarioID)
+	if err != nil {
+		return nil, &Error{Source: s.name, EntityID: scenarioID, Err: err}
+	}
+	file := strings.TrimPrefix(strings.TrimPrefix(scenarioID, s.path), "/")
+	s.checksums[file] = fileChecksum(stream)
+	configMap["stream"] = stream
+	configMap["file"] = scenarioID
+	if _, ok := configMap["format"]; !ok {
+		configMap["format"] = unitool.FormatByExtension(scenarioID)
 	}
-	return nil, fmt.Errorf("file %s doesnt'exists", configMap["id"].(string))
+	conf, positions, err := unitool.UnmarshalWithPositions(configMap["format"].(string), stream)
+	if err != nil {
+		return nil, &Error{Source: s.name, EntityID: scenarioID, Err: err}
+	}
+	configMap["config"], configMap["positions"] = conf, positions
+	return s.Source.LoadConfigEntity(configMap)
 }
 
 func (s *SourceEnv) GetIncludeConfigEntityIds(scenarioID string) ([]string, error) {
@@ -212,27 +370,35 @@ func (s *SourceEnv) LoadConfigEntity(configMap map[string]interface{}) (*ConfigE
 		}
 		return s.Source.LoadConfigEntity(configMap)
 	}
-	return nil, fmt.Errorf("environment variable %s doesnt'exists", configMap["id"].(string))
+	return nil, &Error{Source: s.name, EntityID: configMap["id"].(string), Err: errors.New("environment variable doesn't exist")}
 }
 
 func (s *SourceConfigMap) LoadConfigEntity(configMap map[string]interface{}) (*ConfigEntity, error) {
 	//fmt.Printf("Process %s: %s", configMap["name"], configMap["id"])
-	if _, ok := s.ConfigEntity(configMap["id"].(string)); !ok {
-		if value, ok := s.configMap[configMap["id"].(string)]; ok {
+	id := configMap["id"].(string)
+	if _, ok := s.ConfigEntity(id); !ok {
+		if value, ok := s.configMap[id]; ok {
 			switch value.(type) {
 			case map[string]interface{}:
 				configMap["config"] = value
 			case []byte:
-				// TODO: check if JSON format is needed at all here.
-				format := "yaml"
-				configMap["config"], _ = unitool.UnmarshalByType(format, value.([]byte))
+				format, ok := configMap["format"].(string)
+				if !ok {
+					format = "yaml"
+				}
+				conf, positions, err := unitool.UnmarshalWithPositions(format, value.([]byte))
+				if err != nil {
+					return nil, &Error{Source: s.name, EntityID: id, Err: err}
+				}
+				configMap["config"], configMap["positions"] = conf, positions
+				configMap["stream"], configMap["format"] = value, format
 			}
 			return s.Source.LoadConfigEntity(configMap)
 		}
 	} else {
-		return nil, fmt.Errorf("config entity already loaded: %s", configMap["id"].(string))
+		return nil, &alreadyLoadedError{id: id}
 	}
-	return nil, fmt.Errorf("source config map entry %s doesnt'exists", configMap["id"].(string))
+	return nil, &Error{Source: s.name, EntityID: id, Err: errors.New("source config map entry doesn't exist")}
 }
 
 func (s *SourceConfigMap) GetIncludeConfigEntityIds(scenarioID string) ([]string, error) {
@@ -288,6 +454,7 @@ func NewSourceGoGetter(sourceName string, url string) *SourceGoGetter {
 	return &SourceGoGetter{
 		SourceFile: *NewSourceFile(sourceName, sourceMap),
 		url:        url,
+		ttl:        DefaultSourceTTL,
 	}
 }
 
@@ -296,25 +463,40 @@ func NewSourceRepo(sourceName string, sourceMap map[string]interface{}) *SourceR
 	var ref string
 	if _, ok := sourceMap["ref"]; ok {
 		ref = sourceMap["ref"].(string)
-	} else {
+	} else if _, ok := sourceMap["commit"]; !ok {
 		ref = "master"
 	}
 	prefix, ok := sourceMap["prefix"]
 	if !ok {
 		prefix = refHeadPrefix
 	}
-	return &SourceRepo{
+	if tag, ok := sourceMap["tag"]; ok {
+		ref, prefix = tag.(string), refTagPrefix
+	}
+	source := &SourceRepo{
 		SourceFile: *NewSourceFile(sourceName, sourceMap),
 		repo:       sourceMap["repo"].(string),
 		ref:        ref,
 		refPrefix:  prefix.(string),
+		ttl:        DefaultSourceTTL,
+	}
+	if commit, ok := sourceMap["commit"]; ok {
+		source.commit = commit.(string)
+	}
+	if subpath, ok := sourceMap["subpath"]; ok {
+		source.subpath = subpath.(string)
 	}
+	if auth, ok := sourceMap["auth"]; ok {
+		source.auth = auth.(map[string]interface{})
+	}
+	return source
 }
 
 func NewSourceFile(sourceName string, sourceMap map[string]interface{}) *SourceFile {
 	return &SourceFile{
-		Source: *NewSource(sourceName, sourceMap),
-		path:   sourceMap["path"].(string),
+		Source:    *NewSource(sourceName, sourceMap),
+		path:      sourceMap["path"].(string),
+		checksums: make(map[string]interface{}),
 	}
 }
 
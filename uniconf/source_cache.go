@@ -0,0 +1,132 @@
+package uniconf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheOptions control usage of cached sources.
+type CacheOptions struct {
+	// Path is the cache directory, ".uniconf_cache" is used if it is empty.
+	Path string
+	// Offline allows only cached sources to be used.
+	Offline bool
+	// Refresh forces sources to be fetched even if cached copies are fresh.
+	Refresh bool
+}
+
+// DefaultSourceTTL is the time cached copies of unpinned sources are used without fetching them again
+// if sources don't set the "ttl" spec key, "0s" fetches sources on every run.
+const DefaultSourceTTL = time.Hour
+
+// sourceCacheMeta describes the cached source copy.
+type sourceCacheMeta struct {
+	Key       string    `json:"key"`
+	Commit    string    `json:"commit,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// cacheLocks prevent concurrent fetching of the same cache entry.
+var (
+	cacheLocks   = make(map[string]*sync.Mutex)
+	cacheLocksMu sync.Mutex
+)
+
+func SetCacheOptions(options CacheOptions) { u.SetCacheOptions(options) }
+
+// SetCacheOptions sets options of the source cache.
+func (u *Uniconf) SetCacheOptions(options CacheOptions) {
+	u.cacheMu.Lock()
+	defer u.cacheMu.Unlock()
+	u.cacheOptions = options
+}
+
+func (u *Uniconf) getCacheOptions() CacheOptions {
+	u.cacheMu.RLock()
+	defer u.cacheMu.RUnlock()
+	options := u.cacheOptions
+	if options.Path == "" {
+		options.Path = cacheFilesPath
+	}
+	return options
+}
+
+// cachedSource returns the directory holding the source copy identified by the key, e.g. url & ref.
+// The copy is fetched unless it is cached & fresh: pinned copies never expire, others expire after ttl.
+// fetch populates the directory & returns the resolved commit if there is one.
+func (u *Uniconf) cachedSource(key string, ttl time.Duration, pinned bool, fetch func(dir string) (string, error)) (string, *sourceCacheMeta, error) {
+	options := u.getCacheOptions()
+	hash := sha256.Sum256([]byte(key))
+	dir := path.Join(options.Path, sourcesStoragePath, hex.EncodeToString(hash[:]))
+
+	cacheLocksMu.Lock()
+	lock, ok := cacheLocks[dir]
+	if !ok {
+		lock = new(sync.Mutex)
+		cacheLocks[dir] = lock
+	}
+	cacheLocksMu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	meta := readSourceCacheMeta(dir)
+	if meta != nil {
+		fresh := pinned || (ttl > 0 && time.Since(meta.FetchedAt) < ttl)
+		if options.Offline || (fresh && !options.Refresh) {
+			log.Debugf("Cached source is used: %s", key)
+			return dir, meta, nil
+		}
+	} else if options.Offline {
+		return "", nil, errors.New("source is not cached and can't be fetched in offline mode")
+	}
+
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return "", nil, err
+	}
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	commit, err := fetch(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		if meta != nil && !options.Refresh {
+			log.Warnf("Source %s was not fetched, cached copy is used: %v", key, err)
+			return dir, meta, nil
+		}
+		return "", nil, err
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", nil, err
+	}
+	meta = &sourceCacheMeta{Key: key, Commit: commit, FetchedAt: time.Now()}
+	stream, _ := json.Marshal(meta)
+	if err := ioutil.WriteFile(dir+".meta", stream, 0644); err != nil {
+		return "", nil, fmt.Errorf("write cache metadata: %v", err)
+	}
+	return dir, meta, nil
+}
+
+func readSourceCacheMeta(dir string) *sourceCacheMeta {
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	stream, err := ioutil.ReadFile(dir + ".meta")
+	if err != nil {
+		return nil
+	}
+	meta := &sourceCacheMeta{}
+	if err := json.Unmarshal(stream, meta); err != nil {
+		return nil
+	}
+	return meta
+}
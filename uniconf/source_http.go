@@ -0,0 +1,339 @@
+package uniconf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aroq/uniconf/unitool"
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceHTTP fetches config entities by URL, e.g. "{base_url}/{id}.yaml".
+// Responses are cached on disk and revalidated with ETag & Last-Modified headers.
+type SourceHTTP struct {
+	Source
+	baseURL     string
+	urlTemplate string
+	format      string
+	auth        map[string]interface{}
+	retries     int
+	retryDelay  time.Duration
+	ttl         time.Duration
+	cachePath   string
+	client      *http.Client
+	fetched     map[string][]byte
+}
+
+// httpCacheMeta holds validators of the cached response.
+type httpCacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+const (
+	defaultHTTPURLTemplate = "{base_url}/{id}.yaml"
+	defaultHTTPTimeout     = 30 * time.Second
+	defaultHTTPRetries     = 2
+	defaultHTTPRetryDelay  = time.Second
+)
+
+func (s *SourceHTTP) Path() string {
+	return s.baseURL
+}
+
+func (s *SourceHTTP) entityURL(id string) string {
+	return strings.NewReplacer(
+		"{base_url}", strings.TrimRight(s.baseURL, "/"),
+		"{id}", strings.Trim(id, "/"),
+	).Replace(s.urlTemplate)
+}
+
+func (s *SourceHTTP) GetIncludeConfigEntityIds(id string) ([]string, error) {
+	body, found, err := s.fetch(s.entityURL(id))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return []string{}, nil
+	}
+	s.fetched[id] = body
+	return []string{id}, nil
+}
+
+func (s *SourceHTTP) LoadConfigEntity(configMap map[string]interface{}) (*ConfigEntity, error) {
+	id, ok := configMap["id"].(string)
+	if !ok {
+		return nil, &Error{Source: s.name, Err: errors.New("config map doesn't contain id")}
+	}
+	if _, ok := s.ConfigEntity(id); ok {
+		return nil, &alreadyLoadedError{id: id}
+	}
+	url := s.entityURL(id)
+	body, ok := s.fetched[id]
+	if !ok {
+		var found bool
+		var err error
+		if body, found, err = s.fetch(url); err != nil {
+			return nil, &Error{Source: s.name, EntityID: id, Err: err}
+		}
+		if !found {
+			return nil, &Error{Source: s.name, EntityID: id, Err: fmt.Errorf("%s is not found", url)}
+		}
+	}
+	if _, ok := configMap["format"]; !ok {
+		configMap["format"] = s.format
+		if s.format == "" {
+			configMap["format"] = unitool.FormatByExtension(url)
+		}
+	}
+	conf, positions, err := unitool.UnmarshalWithPositions(configMap["format"].(string), body)
+	if err != nil {
+		return nil, &Error{Source: s.name, EntityID: id, Err: err}
+	}
+	configMap["config"], configMap["positions"] = conf, positions
+	configMap["stream"], configMap["file"] = body, url
+	return s.Source.LoadConfigEntity(configMap)
+}
+
+// fetch returns response body of the url, found is false if the url doesn't exist.
+// Cached response is used without request if it is fresh or in offline mode.
+func (s *SourceHTTP) fetch(url string) (body []byte, found bool, err error) {
+	options := s.uniconf.getCacheOptions()
+	meta, cached := s.readCache(url)
+	if cached != nil {
+		fresh := s.ttl > 0 && time.Since(meta.FetchedAt) < s.ttl
+		if options.Offline || (fresh && !options.Refresh) {
+			log.Debugf("Cached response is used: %s", url)
+			return cached, true, nil
+		}
+	} else if options.Offline {
+		return nil, false, fmt.Errorf("%s is not cached and can't be fetched in offline mode", url)
+	}
+	if options.Refresh {
+		meta, cached = nil, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		body, found, retry, err = s.request(url, meta, cached)
+		if err == nil || !retry || attempt >= s.retries {
+			break
+		}
+		log.Warnf("Request %s failed, retrying: %v", url, err)
+		time.Sleep(s.retryDelay)
+	}
+	if err != nil && cached != nil {
+		log.Warnf("Request %s failed, cached response is used: %v", url, err)
+		return cached, true, nil
+	}
+	return body, found, err
+}
+
+func (s *SourceHTTP) request(url string, meta *httpCacheMeta, cached []byte) (body []byte, found, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := s.authorize(req); err != nil {
+		return nil, false, false, err
+	}
+	if cached != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	log.Debugf("Request: %s", url)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, false, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		log.Debugf("Not modified: %s", url)
+		meta.FetchedAt = time.Now()
+		s.writeCache(url, cached, meta)
+		return cached, true, false, nil
+	case resp.StatusCode == http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, true, err
+		}
+		s.writeCache(url, body, &httpCacheMeta{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			FetchedAt:    time.Now(),
+		})
+		return body, true, false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, false, true, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return nil, false, false, fmt.Errorf("GET %s: %s", url, resp.Status)
+}
+
+// authorize sets authorization header using credentials from environment variables.
+func (s *SourceHTTP) authorize(req *http.Request) error {
+	if s.auth == nil {
+		return nil
+	}
+	getenv := func(key string) (string, error) {
+		name, _ := s.auth[key].(string)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("auth environment variable %q is not set", name)
+		}
+		return value, nil
+	}
+	switch s.auth["type"] {
+	case "bearer":
+		token, err := getenv("token_env")
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		username, err := getenv("username_env")
+		if err != nil {
+			return err
+		}
+		password, err := getenv("password_env")
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(username, password)
+	}
+	return nil
+}
+
+// cacheDir returns the directory of cached responses, "cache_dir" spec key overrides the default one.
+func (s *SourceHTTP) cacheDir() string {
+	if s.cachePath != "" {
+		return s.cachePath
+	}
+	return path.Join(s.uniconf.getCacheOptions().Path, "http", s.name)
+}
+
+func (s *SourceHTTP) cacheFile(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return path.Join(s.cacheDir(), hex.EncodeToString(hash[:]))
+}
+
+func (s *SourceHTTP) readCache(url string) (*httpCacheMeta, []byte) {
+	file := s.cacheFile(url)
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil
+	}
+	meta := &httpCacheMeta{}
+	if stream, err := ioutil.ReadFile(file + ".meta"); err == nil {
+		json.Unmarshal(stream, meta)
+	}
+	return meta, body
+}
+
+func (s *SourceHTTP) writeCache(url string, body []byte, meta *httpCacheMeta) {
+	file := s.cacheFile(url)
+	stream, _ := json.Marshal(meta)
+	err := os.MkdirAll(s.cacheDir(), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(file, body, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file+".meta", stream, 0644)
+	}
+	if err != nil {
+		log.Warnf("Response of %s was not cached: %v", url, err)
+	}
+}
+
+func newSourceHTTPFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	source := &SourceHTTP{
+		Source:      *NewSource(name, spec),
+		urlTemplate: defaultHTTPURLTemplate,
+		retries:     defaultHTTPRetries,
+		retryDelay:  defaultHTTPRetryDelay,
+		fetched:     make(map[string][]byte),
+	}
+	var err error
+	if source.baseURL, err = specString(spec, "base_url", false); err != nil {
+		return nil, err
+	}
+	if template, err := specString(spec, "url_template", false); err != nil {
+		return nil, err
+	} else if template != "" {
+		source.urlTemplate = template
+	}
+	if source.baseURL == "" && strings.Contains(source.urlTemplate, "{base_url}") {
+		return nil, fmt.Errorf("source spec key %q is required", "base_url")
+	}
+	if source.format, err = specString(spec, "format", false); err != nil {
+		return nil, err
+	}
+	if cachePath, err := specString(spec, "cache_dir", false); err != nil {
+		return nil, err
+	} else if cachePath != "" {
+		source.cachePath = cachePath
+	}
+
+	timeout := defaultHTTPTimeout
+	if timeout, err = specDuration(spec, "timeout", timeout); err != nil {
+		return nil, err
+	}
+	source.client = &http.Client{Timeout: timeout}
+	if source.ttl, err = specDuration(spec, "ttl", DefaultSourceTTL); err != nil {
+		return nil, err
+	}
+	if source.retryDelay, err = specDuration(spec, "retry_delay", source.retryDelay); err != nil {
+		return nil, err
+	}
+	if retries, ok := spec["retries"]; ok {
+		switch r := retries.(type) {
+		case int:
+			source.retries = r
+		case float64:
+			source.retries = int(r)
+		default:
+			return nil, fmt.Errorf("source spec key %q should be a number, got %T", "retries", retries)
+		}
+	}
+
+	if auth, ok := spec["auth"]; ok {
+		if source.auth, ok = auth.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("source spec key %q should be a map", "auth")
+		}
+		var keys []string
+		switch source.auth["type"] {
+		case "bearer":
+			keys = []string{"token_env"}
+		case "basic":
+			keys = []string{"username_env", "password_env"}
+		default:
+			return nil, fmt.Errorf("unknown auth type: %v", source.auth["type"])
+		}
+		for _, key := range keys {
+			if _, err := specString(source.auth, key, true); err != nil {
+				return nil, fmt.Errorf("auth: %v", err)
+			}
+		}
+	}
+	return source, nil
+}
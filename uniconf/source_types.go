@@ -0,0 +1,165 @@
+package uniconf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SourceFactory creates a source from its spec declared in the "sources" config key.
+type SourceFactory func(name string, spec map[string]interface{}) (SourceHandler, error)
+
+// defaultSourceType is used if the source spec doesn't declare its type.
+const defaultSourceType = "repo"
+
+var (
+	sourceTypes   = make(map[string]SourceFactory)
+	sourceTypesMu sync.RWMutex
+)
+
+func init() {
+	RegisterSourceType("go-getter", newSourceGoGetterFromSpec)
+	RegisterSourceType("repo", newSourceRepoFromSpec)
+	RegisterSourceType("env", newSourceEnvFromSpec)
+	RegisterSourceType("file", newSourceFileFromSpec)
+	RegisterSourceType("config_map", newSourceConfigMapFromSpec)
+	RegisterSourceType("http", newSourceHTTPFromSpec)
+}
+
+// RegisterSourceType registers the factory creating sources of the type, existing factory is replaced.
+func RegisterSourceType(name string, factory SourceFactory) {
+	sourceTypesMu.Lock()
+	defer sourceTypesMu.Unlock()
+	sourceTypes[name] = factory
+}
+
+// newSourceFromSpec creates source using the factory registered for its type.
+// String spec is handled as the go-getter url.
+func newSourceFromSpec(name string, spec interface{}) (SourceHandler, error) {
+	var specMap map[string]interface{}
+	switch s := spec.(type) {
+	case string:
+		specMap = map[string]interface{}{"type": "go-getter", "url": s}
+	case map[string]interface{}:
+		specMap = s
+	default:
+		return nil, fmt.Errorf("source spec should be a map or a url string, got %T", spec)
+	}
+
+	sourceType := defaultSourceType
+	if t, ok := specMap["type"]; ok {
+		if sourceType, ok = t.(string); !ok {
+			return nil, fmt.Errorf("source type should be a string, got %T", t)
+		}
+	}
+	if _, err := specString(specMap, "autoload", false); err != nil {
+		return nil, err
+	}
+
+	sourceTypesMu.RLock()
+	factory, ok := sourceTypes[sourceType]
+	sourceTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source type: %s", sourceType)
+	}
+	return factory(name, specMap)
+}
+
+// specString returns string value of the spec key.
+func specString(spec map[string]interface{}, key string, required bool) (string, error) {
+	value, ok := spec[key]
+	if !ok {
+		if required {
+			return "", fmt.Errorf("source spec key %q is required", key)
+		}
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("source spec key %q should be a string, got %T", key, value)
+	}
+	return s, nil
+}
+
+// specDuration returns duration value of the spec key, e.g. "10s".
+func specDuration(spec map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	s, err := specString(spec, key, false)
+	if err != nil || s == "" {
+		return defaultValue, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("source spec key %q: %v", key, err)
+	}
+	return d, nil
+}
+
+func newSourceGoGetterFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	url, err := specString(spec, "url", true)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := specDuration(spec, "ttl", DefaultSourceTTL)
+	if err != nil {
+		return nil, err
+	}
+	source := NewSourceGoGetter(name, url)
+	source.ttl = ttl
+	return source, nil
+}
+
+func newSourceRepoFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	for _, key := range []string{"ref", "prefix", "tag", "commit", "subpath"} {
+		if _, err := specString(spec, key, false); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := specString(spec, "repo", true); err != nil {
+		return nil, err
+	}
+	if auth, ok := spec["auth"]; ok {
+		authMap, ok := auth.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("source spec key %q should be a map", "auth")
+		}
+		var credentials []string
+		switch authMap["type"] {
+		case "ssh":
+			credentials = []string{"key_env", "key_file"}
+		case "token":
+			credentials = []string{"token_env", "token_file"}
+		default:
+			return nil, fmt.Errorf("unknown auth type: %v", authMap["type"])
+		}
+		if _, ok := authMap[credentials[0]]; !ok {
+			if _, err := specString(authMap, credentials[1], true); err != nil {
+				return nil, fmt.Errorf("auth: either %q or %q is required", credentials[0], credentials[1])
+			}
+		}
+	}
+	ttl, err := specDuration(spec, "ttl", DefaultSourceTTL)
+	if err != nil {
+		return nil, err
+	}
+	source := NewSourceRepo(name, spec)
+	source.ttl = ttl
+	return source, nil
+}
+
+func newSourceEnvFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	return NewSourceEnv(name, spec), nil
+}
+
+func newSourceFileFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	if _, err := specString(spec, "path", true); err != nil {
+		return nil, err
+	}
+	return NewSourceFile(name, spec), nil
+}
+
+func newSourceConfigMapFromSpec(name string, spec map[string]interface{}) (SourceHandler, error) {
+	if _, ok := spec["configMap"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("source spec key %q should be a map", "configMap")
+	}
+	return NewSourceConfigMap(name, spec), nil
+}
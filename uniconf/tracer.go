@@ -0,0 +1,189 @@
+package uniconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TraceRecord describes a single phase execution.
+type TraceRecord struct {
+	Phase    string        `json:"phase"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	// ConfigDiff is the number of config values added, changed or removed during the phase.
+	ConfigDiff int `json:"config_diff"`
+}
+
+// Tracer records phase executions of the instance.
+type Tracer struct {
+	uniconf *Uniconf
+	mu      sync.Mutex
+	started map[*Phase]traceStart
+	records []TraceRecord
+}
+
+type traceStart struct {
+	start  time.Time
+	config map[string]string
+}
+
+func Trace() *Tracer { return u.Trace() }
+
+// Trace registers hooks recording phase executions and returns the tracer holding records.
+func (u *Uniconf) Trace() *Tracer {
+	t := &Tracer{
+		uniconf: u,
+		started: make(map[*Phase]traceStart),
+	}
+	u.AddBeforeHook(t.before)
+	u.AddAfterHook(t.after)
+	return t
+}
+
+func (t *Tracer) before(phase *Phase, err error) {
+	config := t.configSnapshot()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started[phase] = traceStart{start: time.Now(), config: config}
+}
+
+func (t *Tracer) after(phase *Phase, err error) {
+	end := time.Now()
+	config := t.configSnapshot()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	started, ok := t.started[phase]
+	if !ok {
+		return
+	}
+	delete(t.started, phase)
+	record := TraceRecord{
+		Phase:      phaseFullName(phase),
+		Start:      started.start,
+		End:        end,
+		Duration:   end.Sub(started.start),
+		ConfigDiff: configDiffSize(started.config, config),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	t.records = append(t.records, record)
+}
+
+// configSnapshot returns config values by their paths.
+func (t *Tracer) configSnapshot() map[string]string {
+	snapshot := make(map[string]string)
+	t.uniconf.mu.RLock()
+	defer t.uniconf.mu.RUnlock()
+	flattenValues("", t.uniconf.config, snapshot)
+	return snapshot
+}
+
+func flattenValues(path string, value interface{}, result map[string]string) {
+	if m, ok := value.(map[string]interface{}); ok {
+		for k, v := range m {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			flattenValues(p, v, result)
+		}
+		return
+	}
+	result[path] = fmt.Sprintf("%v", value)
+}
+
+func configDiffSize(before, after map[string]string) int {
+	size := 0
+	for k, v := range before {
+		if value, ok := after[k]; !ok || value != v {
+			size++
+		}
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			size++
+		}
+	}
+	return size
+}
+
+// Records returns recorded phase executions ordered by start time.
+func (t *Tracer) Records() []TraceRecord {
+	t.mu.Lock()
+	records := append([]TraceRecord{}, t.records...)
+	t.mu.Unlock()
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	return records
+}
+
+// WriteJSON writes records as a JSON list.
+func (t *Tracer) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(t.Records())
+}
+
+type chromeTraceEvent struct {
+	Name      string                 `json:"name"`
+	Category  string                 `json:"cat"`
+	Phase     string                 `json:"ph"`
+	Timestamp int64                  `json:"ts"`
+	Duration  int64                  `json:"dur"`
+	PID       int                    `json:"pid"`
+	TID       int                    `json:"tid"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes records in the Chrome trace event format, viewable in chrome://tracing.
+// Concurrently executed phases are placed on separate threads.
+func (t *Tracer) WriteChromeTrace(w io.Writer) error {
+	records := t.Records()
+	events := make([]chromeTraceEvent, 0, len(records))
+	var lanes [][]TraceRecord
+	for _, record := range records {
+		lane := 0
+		for ; lane < len(lanes); lane++ {
+			stack := lanes[lane]
+			for len(stack) > 0 && !stack[len(stack)-1].End.After(record.Start) {
+				stack = stack[:len(stack)-1]
+			}
+			lanes[lane] = stack
+			// Records are nested on the same lane only if the parent lasts longer.
+			if len(stack) == 0 || !stack[len(stack)-1].End.Before(record.End) {
+				break
+			}
+		}
+		if lane == len(lanes) {
+			lanes = append(lanes, nil)
+		}
+		lanes[lane] = append(lanes[lane], record)
+
+		args := map[string]interface{}{"config_diff": record.ConfigDiff}
+		if record.Error != "" {
+			args["error"] = record.Error
+		}
+		events = append(events, chromeTraceEvent{
+			Name:      record.Phase,
+			Category:  "phase",
+			Phase:     "X",
+			Timestamp: record.Start.UnixNano() / int64(time.Microsecond),
+			Duration:  int64(record.Duration / time.Microsecond),
+			PID:       1,
+			TID:       lane + 1,
+			Args:      args,
+		})
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+	})
+}
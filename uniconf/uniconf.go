@@ -15,9 +15,12 @@
 package uniconf
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/aroq/uniconf/unitool"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 type Phase struct {
@@ -28,51 +31,121 @@ type Phase struct {
 	ParentPhase *Phase
 	Result      *interface{}
 	Error       *error
+	OnError     string
+	// DependsOn lists names of sibling phases which should be executed before the phase.
+	// Siblings are executed as a dependency graph if any of them declares dependencies.
+	DependsOn []string
+	// Concurrent marks the callback as safe to run in parallel with other callbacks.
+	// Other callbacks are executed one at a time.
+	Concurrent bool
 }
 
+// Phase error policies.
+const (
+	// PhaseErrorAbort stops execution of all remaining phases (default).
+	PhaseErrorAbort = "abort"
+	// PhaseErrorContinue executes child and remaining phases.
+	PhaseErrorContinue = "continue"
+	// PhaseErrorSkipChildren skips child phases and executes remaining ones.
+	PhaseErrorSkipChildren = "skip-children"
+)
+
+// PhaseHook is called around phase execution, err is the phase callback error and is always nil in before hooks.
+type PhaseHook func(phase *Phase, err error)
+
 type Callback struct {
 	Args   []interface{}
 	Method func([]interface{}) (interface{}, error)
 }
 
 type Uniconf struct {
-	config     map[string]interface{}
-	sources    map[string]SourceHandler
-	flatConfig map[string]interface{}
+	config  map[string]interface{}
+	origins unitool.Origins
+	sources map[string]SourceHandler
 	//contexts     []string
 	phases       map[string]*Phase
 	phasesList   []*Phase
 	currentPhase *Phase
 	rootSource   SourceHandler
+
+	processedFromKeys map[string]interface{}
+	// processedFromOrigins holds origins of processed "from" params keyed by paths in params.
+	processedFromOrigins map[string]unitool.Origins
+
+	beforeHooks []PhaseHook
+	afterHooks  []PhaseHook
+
+	// strictUnmarshal makes unknown keys errors of Unmarshal.
+	strictUnmarshal bool
+	// undefinedMode is the mode of undefined references in interpolations, strict by default.
+	undefinedMode string
+
+	// mu guards the instance state.
+	mu sync.RWMutex
+	// execMu serializes phase callbacks which are not marked as concurrent.
+	execMu sync.Mutex
+	// cacheMu guards cacheOptions which are read while sources are loaded.
+	cacheMu      sync.RWMutex
+	cacheOptions CacheOptions
+	// mergeMu guards mergeOptions which are read while config entities are merged.
+	mergeMu      sync.RWMutex
+	mergeOptions unitool.MergeOptions
+	// secretsMu guards secret stores which are used while the instance is locked.
+	secretsMu     sync.RWMutex
+	secretStores  map[string]SecretStore
+	revealSecrets bool
+	// sourceLocks prevent concurrent loading of the same source.
+	sourceLocks   map[string]*sync.Mutex
+	sourceLocksMu sync.Mutex
 }
 
-var u *Uniconf
+// u is the default instance used by the package-level functions.
+var u = New()
 
 const (
 	appTempFilesPath       = ".unipipe_temp"
+	cacheFilesPath         = ".uniconf_cache"
 	sourceMapElementName   = "sources"
 	IncludeListElementName = "from"
 	sourcesStoragePath     = "sources"
 	mainConfigFileName     = "config.yaml"
 )
 
+// SourcesMetadataElementName is the config key holding metadata of loaded sources.
+const SourcesMetadataElementName = "sources_metadata"
+
 // New returns an initialized Uniconf instance.
 func New() *Uniconf {
-	u = new(Uniconf)
-	u.config = make(map[string]interface{})
-	u.sources = make(map[string]SourceHandler)
-	u.phasesList = make([]*Phase, 0)
-	u.phases = make(map[string]*Phase)
+	return &Uniconf{
+		config:               make(map[string]interface{}),
+		origins:              make(unitool.Origins),
+		sources:              make(map[string]SourceHandler),
+		phasesList:           make([]*Phase, 0),
+		phases:               make(map[string]*Phase),
+		processedFromKeys:    make(map[string]interface{}),
+		processedFromOrigins: make(map[string]unitool.Origins),
+		sourceLocks:          make(map[string]*sync.Mutex),
+		mergeOptions:         unitool.MergeOptions{Override: true, Paths: make(map[string]unitool.ListStrategy)},
+		secretStores:         make(map[string]SecretStore),
+		undefinedMode:        UndefinedStrict,
+	}
+}
+
+// Default returns the instance used by the package-level functions.
+func Default() *Uniconf {
 	return u
 }
 
-// Init initializes uniconf.
-func init() {
-	log.SetLevel(log.DebugLevel)
-	u = New()
+// SetDefault replaces the instance used by the package-level functions.
+func SetDefault(instance *Uniconf) {
+	u = instance
 }
 
 func phaseFullName(phase *Phase) string {
+	if phase == nil {
+		// Processors are called outside of phases too.
+		return ""
+	}
 	name := ""
 	if phase.ParentPhase != nil {
 		name = phaseFullName(phase.ParentPhase) + "."
@@ -81,76 +154,265 @@ func phaseFullName(phase *Phase) string {
 	return name
 }
 
-func SetRootSource(sourceName string) { u.setRootSource(sourceName) }
-func (u *Uniconf) setRootSource(sourceName string) {
-	if source := u.getSource(sourceName); source != nil {
-		u.rootSource = source
-	} else {
-		log.Errorf("source %s is not found", sourceName)
+// FullName returns the phase name prefixed with names of its parents, e.g. "config.load".
+func (p *Phase) FullName() string {
+	return phaseFullName(p)
+}
+
+func AddBeforeHook(hook PhaseHook) { u.AddBeforeHook(hook) }
+
+// AddBeforeHook registers the hook called before each phase is executed.
+func (u *Uniconf) AddBeforeHook(hook PhaseHook) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.beforeHooks = append(u.beforeHooks, hook)
+}
+
+func AddAfterHook(hook PhaseHook) { u.AddAfterHook(hook) }
+
+// AddAfterHook registers the hook called after each phase and its child phases are executed.
+func (u *Uniconf) AddAfterHook(hook PhaseHook) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.afterHooks = append(u.afterHooks, hook)
+}
+
+func (u *Uniconf) runHooks(hooks []PhaseHook, phase *Phase, err error) {
+	for _, hook := range hooks {
+		hook(phase, err)
+	}
+}
+
+func SetRootSource(sourceName string) error { return u.SetRootSource(sourceName) }
+
+// SetRootSource sets the source the "root" config entity is loaded from.
+func (u *Uniconf) SetRootSource(sourceName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	source, err := u.getSource(sourceName)
+	if err != nil {
+		return err
+	}
+	u.rootSource = source
+	return nil
+}
+
+func Execute() error { return u.Execute() }
+
+// Execute runs all added phases and returns Errors if any of them failed.
+func (u *Uniconf) Execute() error {
+	u.mu.RLock()
+	phases := u.phasesList
+	u.mu.RUnlock()
+	if err := validatePhases(nil, phases); err != nil {
+		return Errors{err}
+	}
+	errs, _ := u.execute(nil, phases)
+	if len(errs) > 0 {
+		return errs
 	}
+	return nil
 }
 
-func Execute() { u.execute(nil, u.phasesList) }
-func (u *Uniconf) execute(parentPhase *Phase, phases []*Phase) {
+func (u *Uniconf) execute(parentPhase *Phase, phases []*Phase) (errs Errors, aborted bool) {
 	for _, phase := range phases {
 		phase.ParentPhase = parentPhase
-		u.currentPhase = phase
-		log.Debugf("Execute phase: %s", phaseFullName(phase))
-		if phase.Callback != nil {
-			result, err := phase.Callback(phase.Args)
-			if err != nil {
-				log.Errorf("error: %v", err)
+		if len(phase.DependsOn) > 0 {
+			return u.executeGraph(phases)
+		}
+	}
+	for _, phase := range phases {
+		phaseErrs, phaseAborted := u.executePhase(phase)
+		errs = append(errs, phaseErrs...)
+		if phaseAborted {
+			return errs, true
+		}
+	}
+	return errs, false
+}
+
+// executePhase executes the phase callback & its child phases.
+func (u *Uniconf) executePhase(phase *Phase) (errs Errors, aborted bool) {
+	log.Debugf("Execute phase: %s", phaseFullName(phase))
+	u.mu.RLock()
+	beforeHooks, afterHooks := u.beforeHooks, u.afterHooks
+	u.mu.RUnlock()
+	u.runHooks(beforeHooks, phase, nil)
+	var phaseErr error
+	defer func() {
+		u.runHooks(afterHooks, phase, phaseErr)
+	}()
+
+	if phase.Callback != nil {
+		result, err := u.runCallback(phase)
+		if phase.Result != nil {
+			*phase.Result = result
+		}
+		if err != nil {
+			phaseErrs := toErrors(err)
+			for _, e := range phaseErrs {
+				if e.Phase == "" {
+					e.Phase = phaseFullName(phase)
+				}
+				log.Errorf("error: %v", e)
 			}
-			if phase.Result != nil {
-				*phase.Result = result
+			if len(phaseErrs) == 1 {
+				err = phaseErrs[0]
+			} else {
+				err = phaseErrs
 			}
-			if phase.Error != nil {
-				phase.Error = &err
+			phaseErr = err
+			errs = append(errs, phaseErrs...)
+		}
+		if phase.Error != nil {
+			*phase.Error = err
+		}
+		if err != nil {
+			switch phase.OnError {
+			case PhaseErrorContinue:
+			case PhaseErrorSkipChildren:
+				return errs, false
+			default:
+				return errs, true
 			}
 		}
-		if phase.Phases != nil {
-			u.execute(phase, phase.Phases)
+	}
+	if phase.Phases != nil {
+		childErrs, childAborted := u.execute(phase, phase.Phases)
+		errs = append(errs, childErrs...)
+		if childAborted {
+			return errs, true
 		}
 	}
+	return errs, false
+}
+
+func (u *Uniconf) runCallback(phase *Phase) (interface{}, error) {
+	if phase.Concurrent {
+		return phase.Callback(phase.Args)
+	}
+	u.execMu.Lock()
+	defer u.execMu.Unlock()
+	u.mu.Lock()
+	u.currentPhase = phase
+	u.mu.Unlock()
+	return phase.Callback(phase.Args)
 }
 
 func Config() map[string]interface{} { return u.Config() }
+
+// Config returns the copy of the resulting configuration, merge directives are removed from it, escaped
+// interpolations are unescaped & secrets are revealed. Interpolations depending on secrets are kept as is
+// if secrets can't be revealed.
 func (u *Uniconf) Config() map[string]interface{} {
-	return u.config
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.revealedConfig()
+	if err != nil {
+		log.Errorf("Secrets are not revealed: %v", err)
+		return unescapeInterpolations(unitool.StripDirectives(u.config)).(map[string]interface{})
+	}
+	return config
 }
 
 func (u *Uniconf) mergeConfigEntity(configEntity *ConfigEntity) {
-	unitool.Merge(u.config, configEntity.config, true)
+	unitool.MergeWithOrigins(u.config, configEntity.config, u.getMergeOptions(), u.origins, configEntity.origins)
+}
+
+func SetListMergeStrategy(path string, strategy unitool.ListStrategy) {
+	u.SetListMergeStrategy(path, strategy)
+}
+
+// SetListMergeStrategy sets the strategy of merging lists of config entities by the dotted key path,
+// e.g. "jobs.*.tags", the default strategy is set if the path is empty.
+func (u *Uniconf) SetListMergeStrategy(path string, strategy unitool.ListStrategy) {
+	u.mergeMu.Lock()
+	defer u.mergeMu.Unlock()
+	if path == "" {
+		u.mergeOptions.Lists = strategy
+		return
+	}
+	u.mergeOptions.Paths[path] = strategy
+}
+
+func (u *Uniconf) getMergeOptions() unitool.MergeOptions {
+	u.mergeMu.RLock()
+	defer u.mergeMu.RUnlock()
+	options := u.mergeOptions
+	options.Paths = make(map[string]unitool.ListStrategy, len(u.mergeOptions.Paths))
+	for path, strategy := range u.mergeOptions.Paths {
+		options.Paths[path] = strategy
+	}
+	return options
+}
+
+func AddSource(source SourceHandler) { u.AddSource(source) }
+
+// AddSource registers source in the instance.
+func (u *Uniconf) AddSource(source SourceHandler) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addSource(source)
 }
 
-func AddSource(source SourceHandler) { u.addSource(source) }
 func (u *Uniconf) addSource(source SourceHandler) {
 	if _, ok := u.sources[source.Name()]; !ok {
+		source.SetUniconf(u)
 		u.sources[source.Name()] = source
 	}
 }
 
-func (u *Uniconf) getSource(name string) SourceHandler {
+func (u *Uniconf) getSource(name string) (SourceHandler, error) {
 	if source, ok := u.sources[name]; ok {
-		if !source.IsLoaded() {
-			// Lazy load source.
-			err := source.LoadSource()
-			if err != nil {
-				log.Fatalf("Source: %s was not loaded because of source.getSource() error: %v", name, err)
-			}
+		// Lazy load source.
+		if err := u.loadSource(source); err != nil {
+			return nil, err
 		}
-		return source
+		return source, nil
 	}
 
-	log.Fatalf("Source: %s is not registered", name)
+	return nil, &Error{Source: name, Err: errors.New("source is not registered")}
+}
+
+// sourceLock returns the lock guarding loading of the source.
+func (u *Uniconf) sourceLock(name string) *sync.Mutex {
+	u.sourceLocksMu.Lock()
+	defer u.sourceLocksMu.Unlock()
+	lock, ok := u.sourceLocks[name]
+	if !ok {
+		lock = new(sync.Mutex)
+		u.sourceLocks[name] = lock
+	}
+	return lock
+}
+
+// loadSource loads the source unless it is already loaded.
+func (u *Uniconf) loadSource(source SourceHandler) error {
+	lock := u.sourceLock(source.Name())
+	lock.Lock()
+	defer lock.Unlock()
+	if !source.IsLoaded() {
+		if err := source.LoadSource(); err != nil {
+			return &Error{Source: source.Name(), Err: fmt.Errorf("source was not loaded: %v", err)}
+		}
+	}
 	return nil
 }
 
-func (u *Uniconf) allSettings(v *viper.Viper) map[string]interface{} {
-	result := make(map[string]interface{})
-	keys := v.AllKeys()
-	for _, value := range keys {
-		result[value] = v.Get(value)
+// sourcesMetadata returns metadata of loaded sources by source names.
+func (u *Uniconf) sourcesMetadata() map[string]interface{} {
+	metadata := make(map[string]interface{})
+	for name, source := range u.sources {
+		provider, ok := source.(SourceMetadataProvider)
+		if !ok {
+			continue
+		}
+		lock := u.sourceLock(name)
+		lock.Lock()
+		if source.IsLoaded() {
+			metadata[name] = provider.Metadata()
+		}
+		lock.Unlock()
 	}
-	return result
+	return metadata
 }
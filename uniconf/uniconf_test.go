@@ -2,18 +2,32 @@ package uniconf_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aroq/uniconf/uniconf"
 	"github.com/aroq/uniconf/unitool"
+	"github.com/hashicorp/hil/ast"
 	"github.com/juju/testing/checkers"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 // PrepareTest provides config values.
 func PrepareTest() {
-	uniconf.New()
+	uniconf.SetDefault(uniconf.New())
 
 	// Set environment variables.
 	var envVars = map[string][]byte{
@@ -76,7 +90,7 @@ func PrepareTest() {
 
 // PrepareFromHierarchyTest provides config values.
 func PrepareFromHierarchyTest() {
-	uniconf.New()
+	uniconf.SetDefault(uniconf.New())
 
 	// Set environment variables.
 	var envVars = map[string][]byte{
@@ -184,17 +198,21 @@ func TestLoadWithFlattenConfig(t *testing.T) {
 		},
 	})
 
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
 	uniconf.Execute()
+	log.SetOutput(os.Stderr)
+	assert.Contains(t, logs.String(), "The flatten_config phase callback is deprecated")
 
 	t.Run("InterpolateString", func(t *testing.T) {
 		t.Run("${log_level}==DEBUG", func(t *testing.T) {
-			result := uniconf.InterpolateString("${log_level}", nil)
+			result, _ := uniconf.InterpolateString("${log_level}", nil)
 			if result != "DEBUG" {
 				t.Errorf("Interpolate string failed: expected value: 'master', real value: %v", result)
 			}
 		})
 		t.Run("${deepGet(log_level)}==DEBUG", func(t *testing.T) {
-			result := uniconf.InterpolateString("${deepGet(\"log_level\")}", nil)
+			result, _ := uniconf.InterpolateString("${deepGet(\"log_level\")}", nil)
 			if result != "DEBUG" {
 				t.Errorf("Interpolate string with initial deepGet() failed: expected value: 'master', real value: %v", result)
 			}
@@ -356,6 +374,1839 @@ func TestLoadFromHierarchyProcess(t *testing.T) {
 	//})
 }
 
+// TestInstances tests that instances don't share state.
+func TestInstances(t *testing.T) {
+	uniconf.SetDefault(uniconf.New())
+
+	newInstance := func(logLevel string) *uniconf.Uniconf {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"from": []interface{}{
+						"project:root",
+					},
+				},
+			},
+		}))
+		u.SetRootSource("root")
+		u.AddSource(uniconf.NewSourceConfigMap("project", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"log_level": logLevel,
+					"jobs": map[string]interface{}{
+						"install": map[string]interface{}{
+							"from": ".params.install",
+						},
+					},
+					"params": map[string]interface{}{
+						"install": map[string]interface{}{
+							"params": map[string]interface{}{
+								"level": logLevel,
+							},
+						},
+					},
+				},
+			},
+		}))
+		u.AddPhase(&uniconf.Phase{
+			Name: "config",
+			Phases: []*uniconf.Phase{
+				{
+					Name:     "load",
+					Callback: u.Load,
+				},
+				{
+					Name:     "flatten_config",
+					Callback: u.FlattenConfig,
+				},
+				{
+					Name:     "process",
+					Callback: u.ProcessKeys,
+					Args: []interface{}{
+						"jobs",
+						"",
+						[]*uniconf.Processor{
+							{
+								Callback:    u.FromProcess,
+								IncludeKeys: []string{uniconf.IncludeListElementName},
+							},
+						},
+					},
+				},
+			},
+		})
+		return u
+	}
+
+	u1 := newInstance("INFO")
+	u2 := newInstance("TRACE")
+	assert.NoError(t, u1.Execute())
+	assert.NoError(t, u2.Execute())
+
+	t.Run("configs are independent", func(t *testing.T) {
+		assert.Equal(t, "INFO", u1.Config()["log_level"])
+		assert.Equal(t, "TRACE", u2.Config()["log_level"])
+		assert.Equal(t, "INFO", unitool.SearchMapWithPathStringPrefixes(u1.Config(), "jobs.install.level"))
+		assert.Equal(t, "TRACE", unitool.SearchMapWithPathStringPrefixes(u2.Config(), "jobs.install.level"))
+		s1, _ := u1.InterpolateString("${log_level}", nil)
+		s2, _ := u2.InterpolateString("${log_level}", nil)
+		assert.Equal(t, "INFO", s1)
+		assert.Equal(t, "TRACE", s2)
+	})
+	t.Run("default instance is untouched", func(t *testing.T) {
+		assert.Empty(t, uniconf.Config())
+	})
+}
+
+// TestExecuteErrors tests error propagation through phases.
+func TestExecuteErrors(t *testing.T) {
+	failing := func(inputs []interface{}) (interface{}, error) {
+		return nil, errors.New("failed")
+	}
+	var executed []string
+	track := func(inputs []interface{}) (interface{}, error) {
+		executed = append(executed, inputs[0].(string))
+		return nil, nil
+	}
+
+	t.Run("policies", func(t *testing.T) {
+		var phaseErr error
+		u := uniconf.New()
+		u.AddPhase(&uniconf.Phase{
+			Name:     "continue",
+			Callback: failing,
+			OnError:  uniconf.PhaseErrorContinue,
+			Error:    &phaseErr,
+			Phases: []*uniconf.Phase{
+				{Name: "child", Callback: track, Args: []interface{}{"continue.child"}},
+			},
+		})
+		u.AddPhase(&uniconf.Phase{
+			Name:     "skip",
+			Callback: failing,
+			OnError:  uniconf.PhaseErrorSkipChildren,
+			Phases: []*uniconf.Phase{
+				{Name: "child", Callback: track, Args: []interface{}{"skip.child"}},
+			},
+		})
+		u.AddPhase(&uniconf.Phase{
+			Name: "abort",
+			Phases: []*uniconf.Phase{
+				{Name: "failing", Callback: failing},
+				{Name: "next", Callback: track, Args: []interface{}{"abort.next"}},
+			},
+		})
+		u.AddPhase(&uniconf.Phase{Name: "last", Callback: track, Args: []interface{}{"last"}})
+
+		err := u.Execute()
+		assert.Equal(t, []string{"continue.child"}, executed)
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			errs := err.(uniconf.Errors)
+			assert.Len(t, errs, 3)
+			assert.Equal(t, "continue", errs[0].Phase)
+			assert.Equal(t, "skip", errs[1].Phase)
+			assert.Equal(t, "abort.failing", errs[2].Phase)
+		}
+		assert.EqualError(t, phaseErr, "phase continue: failed")
+	})
+
+	t.Run("unregistered source", func(t *testing.T) {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"from": []interface{}{"project:root"},
+				},
+			},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		u.AddPhase(&uniconf.Phase{
+			Name: "config",
+			Phases: []*uniconf.Phase{
+				{Name: "load", Callback: u.Load},
+			},
+		})
+
+		err := u.Execute()
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			e := err.(uniconf.Errors)[0]
+			assert.Equal(t, "config.load", e.Phase)
+			assert.Equal(t, "project", e.Source)
+			assert.EqualError(t, e, "phase config.load: source project: source is not registered")
+		}
+	})
+
+	t.Run("key path", func(t *testing.T) {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"jobs": map[string]interface{}{
+						"install": map[string]interface{}{
+							"from": ".params.${unknown",
+						},
+					},
+				},
+			},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load})
+		u.AddPhase(&uniconf.Phase{
+			Name:     "process",
+			Callback: u.ProcessKeys,
+			Args: []interface{}{
+				"jobs",
+				"",
+				[]*uniconf.Processor{
+					{
+						Callback:    u.FromProcess,
+						IncludeKeys: []string{uniconf.IncludeListElementName},
+					},
+				},
+			},
+		})
+
+		err := u.Execute()
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			e := err.(uniconf.Errors)[0]
+			assert.Equal(t, "process", e.Phase)
+			assert.Equal(t, "jobs.install.from", e.Path)
+		}
+	})
+
+	t.Run("entity handler", func(t *testing.T) {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": []byte(`
+entities:
+  job:
+    children_key: jobs
+    retrieve_handler: DeepCollectChildrn
+jobs:
+  install: {image: php}
+`),
+			},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load})
+		u.AddPhase(&uniconf.Phase{Name: "context", Callback: u.ProcessContext, Args: []interface{}{"job", "install"}})
+
+		err := u.Execute()
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			e := err.(uniconf.Errors)[0]
+			assert.Equal(t, "entities.job.retrieve_handler", e.Path)
+			assert.Contains(t, e.Error(), "unknown retrieve handler: DeepCollectChildrn")
+		}
+	})
+
+	t.Run("aggregated errors", func(t *testing.T) {
+		var phaseErr error
+		u := uniconf.New()
+		u.AddPhase(&uniconf.Phase{
+			Name: "validate",
+			Callback: func(inputs []interface{}) (interface{}, error) {
+				return nil, &uniconf.Error{Source: "root", Err: uniconf.Errors{
+					{Path: "a", Err: errors.New("invalid")},
+					{Path: "b", Err: uniconf.Errors{{Err: errors.New("missing")}}},
+				}}
+			},
+			Error: &phaseErr,
+		})
+
+		err := u.Execute()
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			errs := err.(uniconf.Errors)
+			if assert.Len(t, errs, 2) {
+				assert.EqualError(t, errs[0], "phase validate: source root: key a: invalid")
+				assert.EqualError(t, errs[1], "phase validate: source root: key b: missing")
+			}
+		}
+		assert.IsType(t, uniconf.Errors{}, phaseErr)
+	})
+}
+
+// TestLoadPhases tests phases declared in config.
+func TestLoadPhases(t *testing.T) {
+	newInstance := func(phases string) *uniconf.Uniconf {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": []byte(phases + `
+jobs:
+  install:
+    from: .params.${deepGet("install_type")}
+install_type: install
+params:
+  install:
+    params:
+      level: INFO
+`),
+			},
+		}))
+		u.SetRootSource("root")
+		return u
+	}
+
+	t.Run("named pipeline", func(t *testing.T) {
+		u := newInstance(`
+phases:
+  default:
+  - name: config
+    phases:
+    - name: load
+      callback: load
+    - name: flatten_config
+      callback: flatten_config
+  - name: process
+    callback: process_keys
+    args: [jobs, "", [from_processor]]
+`)
+		declared, err := u.LoadPhases("default")
+		assert.NoError(t, err)
+		assert.True(t, declared)
+		assert.NoError(t, u.Execute())
+		assert.Equal(t, "INFO", unitool.SearchMapWithPathStringPrefixes(u.Config(), "jobs.install.level"))
+
+		declared, err = newInstance(`
+phases:
+  default: []
+`).LoadPhases("context")
+		assert.NoError(t, err)
+		assert.False(t, declared)
+	})
+
+	t.Run("interpolated args", func(t *testing.T) {
+		u := newInstance(`
+phases:
+- name: flatten_config
+  callback: flatten_config
+- name: process
+  callback: process_keys
+  args: ['${deepGet("process_path")}', "", [from_processor]]
+process_path: jobs
+`)
+		declared, err := u.LoadPhases("default")
+		assert.NoError(t, err)
+		assert.True(t, declared)
+		assert.NoError(t, u.Execute())
+		assert.Equal(t, "INFO", unitool.SearchMapWithPathStringPrefixes(u.Config(), "jobs.install.level"))
+	})
+
+	t.Run("unknown callback", func(t *testing.T) {
+		u := newInstance(`
+phases:
+- name: process
+  callback: unknown
+`)
+		_, err := u.LoadPhases("default")
+		assert.EqualError(t, err, "key phases: phase 0: process: unknown callback: unknown")
+	})
+}
+
+// TestPhaseGraph tests execution of phases with dependencies.
+func TestPhaseGraph(t *testing.T) {
+	noop := func(inputs []interface{}) (interface{}, error) { return nil, nil }
+
+	t.Run("cycle", func(t *testing.T) {
+		u := uniconf.New()
+		u.AddPhase(&uniconf.Phase{Name: "a", Callback: noop, DependsOn: []string{"b"}})
+		u.AddPhase(&uniconf.Phase{Name: "b", Callback: noop, DependsOn: []string{"a"}})
+		assert.EqualError(t, u.Execute(), "1 error(s) occurred:\n* phase dependency cycle: a -> b -> a")
+	})
+
+	t.Run("unknown dependency", func(t *testing.T) {
+		u := uniconf.New()
+		u.AddPhase(&uniconf.Phase{
+			Name: "config",
+			Phases: []*uniconf.Phase{
+				{Name: "a", Callback: noop, DependsOn: []string{"unknown"}},
+			},
+		})
+		err := u.Execute()
+		if assert.IsType(t, uniconf.Errors{}, err) {
+			assert.EqualError(t, err.(uniconf.Errors)[0], "phase config: phase a depends on unknown phase: unknown")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		left, right := make(chan bool), make(chan bool)
+		// Both phases wait for each other, so they only finish if executed concurrently.
+		wait := func(send, receive chan bool, result string) func([]interface{}) (interface{}, error) {
+			return func([]interface{}) (interface{}, error) {
+				go func() { send <- true }()
+				select {
+				case <-receive:
+					return result, nil
+				case <-time.After(5 * time.Second):
+					return nil, errors.New("timeout")
+				}
+			}
+		}
+		var leftResult, rightResult, joined interface{}
+		u := uniconf.New()
+		u.AddPhase(&uniconf.Phase{Name: "left", Callback: wait(right, left, "left"), Result: &leftResult, Concurrent: true})
+		u.AddPhase(&uniconf.Phase{Name: "right", Callback: wait(left, right, "right"), Result: &rightResult, Concurrent: true})
+		u.AddPhase(&uniconf.Phase{
+			Name:      "join",
+			DependsOn: []string{"left", "right"},
+			Callback: func([]interface{}) (interface{}, error) {
+				joined = []interface{}{leftResult, rightResult}
+				return nil, nil
+			},
+		})
+		assert.NoError(t, u.Execute())
+		assert.Equal(t, []interface{}{"left", "right"}, joined)
+	})
+
+	t.Run("load sources", func(t *testing.T) {
+		u := uniconf.New()
+		for _, name := range []string{"first", "second"} {
+			u.AddSource(uniconf.NewSourceConfigMap(name, map[string]interface{}{
+				"configMap": map[string]interface{}{
+					"root": map[string]interface{}{"name": name},
+				},
+			}))
+		}
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"from": []interface{}{"first:root", "second:root"},
+				},
+			},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		u.AddPhase(&uniconf.Phase{Name: "sources", Callback: u.LoadSources, Concurrent: true})
+		u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load, DependsOn: []string{"sources"}})
+		assert.NoError(t, u.Execute())
+		assert.Equal(t, "second", u.Config()["name"])
+
+		_, err := u.LoadSources([]interface{}{"unknown"})
+		assert.EqualError(t, err, "source unknown: source is not registered")
+	})
+}
+
+// TestTracer tests phase hooks & tracer records.
+func TestTracer(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"a": "1",
+				"b": map[string]interface{}{"c": "2"},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+
+	var hooks []string
+	u.AddBeforeHook(func(phase *uniconf.Phase, err error) {
+		hooks = append(hooks, "before "+phase.FullName())
+	})
+	u.AddAfterHook(func(phase *uniconf.Phase, err error) {
+		hooks = append(hooks, "after "+phase.FullName())
+	})
+	tracer := u.Trace()
+
+	u.AddPhase(&uniconf.Phase{
+		Name: "config",
+		Phases: []*uniconf.Phase{
+			{Name: "load", Callback: u.Load},
+		},
+	})
+	u.AddPhase(&uniconf.Phase{
+		Name:    "failing",
+		OnError: uniconf.PhaseErrorContinue,
+		Callback: func([]interface{}) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+	})
+	assert.Error(t, u.Execute())
+	assert.Equal(t, []string{"before config", "before config.load", "after config.load", "after config", "before failing", "after failing"}, hooks)
+
+	records := tracer.Records()
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "config", records[0].Phase)
+		assert.Equal(t, "config.load", records[1].Phase)
+		assert.Equal(t, 2, records[1].ConfigDiff)
+		assert.Equal(t, records[1].End.Sub(records[1].Start), records[1].Duration)
+		assert.Equal(t, "phase failing: failed", records[2].Error)
+		assert.Equal(t, 0, records[2].ConfigDiff)
+	}
+
+	var buffer bytes.Buffer
+	assert.NoError(t, tracer.WriteJSON(&buffer))
+	var jsonRecords []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buffer.Bytes(), &jsonRecords))
+	assert.Equal(t, "config.load", jsonRecords[1]["phase"])
+
+	buffer.Reset()
+	assert.NoError(t, tracer.WriteChromeTrace(&buffer))
+	var chromeTrace struct {
+		TraceEvents []map[string]interface{} `json:"traceEvents"`
+	}
+	assert.NoError(t, json.Unmarshal(buffer.Bytes(), &chromeTrace))
+	if assert.Len(t, chromeTrace.TraceEvents, 3) {
+		assert.Equal(t, "X", chromeTrace.TraceEvents[0]["ph"])
+		assert.Equal(t, "config.load", chromeTrace.TraceEvents[1]["name"])
+		assert.Equal(t, float64(1), chromeTrace.TraceEvents[1]["tid"])
+	}
+}
+
+// TestSourceTypes tests source types registry.
+func TestSourceTypes(t *testing.T) {
+	uniconf.RegisterSourceType("test_map", func(name string, spec map[string]interface{}) (uniconf.SourceHandler, error) {
+		value, ok := spec["value"].(string)
+		if !ok {
+			return nil, errors.New("value is required")
+		}
+		return uniconf.NewSourceConfigMap(name, map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{"value": value},
+			},
+		}), nil
+	})
+
+	load := func(sources map[string]interface{}) (*uniconf.Uniconf, error) {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"sources": sources,
+					"from":    []interface{}{"custom:root"},
+				},
+			},
+		}))
+		u.SetRootSource("root")
+		_, err := u.Load(nil)
+		return u, err
+	}
+
+	u, err := load(map[string]interface{}{
+		"custom": map[string]interface{}{"type": "test_map", "value": "registered"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "registered", u.Config()["value"])
+
+	_, err = load(map[string]interface{}{
+		"custom": map[string]interface{}{"type": "unknown"},
+	})
+	assert.EqualError(t, err, "source root: entity root: key sources.custom: unknown source type: unknown")
+
+	_, err = load(map[string]interface{}{
+		"custom": map[string]interface{}{"type": "test_map"},
+	})
+	assert.EqualError(t, err, "source root: entity root: key sources.custom: value is required")
+
+	_, err = load(map[string]interface{}{
+		"custom": map[string]interface{}{"type": "repo", "ref": "master"},
+	})
+	assert.EqualError(t, err, `source root: entity root: key sources.custom: source spec key "repo" is required`)
+}
+
+// TestSourceHTTP tests http source requests & cache revalidation.
+func TestSourceHTTP(t *testing.T) {
+	os.Setenv("UNICONF_TEST_HTTP_TOKEN", "secret")
+	cacheDir, err := ioutil.TempDir("", "uniconf_http")
+	assert.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	var requests []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("If-None-Match"))
+		switch {
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path != "/pipelines/default.yaml":
+			w.WriteHeader(http.StatusNotFound)
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("log_level: INFO\n"))
+		}
+	}))
+	defer server.Close()
+
+	load := func() (*uniconf.Uniconf, error) {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"sources": map[string]interface{}{
+						"shared": map[string]interface{}{
+							"type":        "http",
+							"base_url":    server.URL + "/pipelines/",
+							"cache_dir":   cacheDir,
+							"retry_delay": "1ms",
+							"ttl":         "0s",
+							"auth": map[string]interface{}{
+								"type":      "bearer",
+								"token_env": "UNICONF_TEST_HTTP_TOKEN",
+							},
+						},
+					},
+					"from": []interface{}{"shared:default", "shared:missing"},
+				},
+			},
+		}))
+		u.SetRootSource("root")
+		_, err := u.Load(nil)
+		return u, err
+	}
+
+	u, err := load()
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", u.Config()["log_level"])
+
+	u, err = load()
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", u.Config()["log_level"])
+	assert.Equal(t, []string{
+		"/pipelines/default.yaml ",
+		"/pipelines/default.yaml ",
+		"/pipelines/missing.yaml ",
+		`/pipelines/default.yaml "v1"`,
+		"/pipelines/missing.yaml ",
+	}, requests)
+}
+
+// prepareTestRepo creates the bare repository with two commits, the first one is tagged as "v1".
+func prepareTestRepo(t *testing.T, dir string) (remote string, first, last plumbing.Hash) {
+	workDir := filepath.Join(dir, "work")
+	repo, err := git.PlainInit(workDir, false)
+	assert.NoError(t, err)
+	worktree, err := repo.Worktree()
+	assert.NoError(t, err)
+	commit := func(level string) plumbing.Hash {
+		assert.NoError(t, os.MkdirAll(filepath.Join(workDir, "configs"), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(workDir, "configs", "root.yaml"), []byte("log_level: "+level+"\n"), 0644))
+		_, err := worktree.Add("configs/root.yaml")
+		assert.NoError(t, err)
+		hash, err := worktree.Commit(level, &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		assert.NoError(t, err)
+		return hash
+	}
+	first = commit("DEBUG")
+	_, err = repo.CreateTag("v1", first, nil)
+	assert.NoError(t, err)
+	last = commit("INFO")
+	remote = filepath.Join(dir, "remote.git")
+	_, err = git.PlainClone(remote, true, &git.CloneOptions{URL: workDir})
+	assert.NoError(t, err)
+	return remote, first, last
+}
+
+// loadTestRepoSource loads config including the entity of the "drupipe" repo source.
+func loadTestRepoSource(spec map[string]interface{}, include string, options uniconf.CacheOptions) (*uniconf.Uniconf, error) {
+	spec["type"] = "repo"
+	u := uniconf.New()
+	u.SetCacheOptions(options)
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"sources": map[string]interface{}{"drupipe": spec},
+				"from":    []interface{}{"drupipe:" + include},
+			},
+		},
+	}))
+	u.SetRootSource("root")
+	_, err := u.Load(nil)
+	return u, err
+}
+
+// TestSourceRepo tests repo sources pinned to tags & commits.
+func TestSourceRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_repo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, first, last := prepareTestRepo(t, dir)
+	options := uniconf.CacheOptions{Path: filepath.Join(dir, "cache")}
+	load := func(spec map[string]interface{}, include string) (*uniconf.Uniconf, error) {
+		spec["repo"] = remote
+		return loadTestRepoSource(spec, include, options)
+	}
+
+	u, err := load(map[string]interface{}{}, "configs/root.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", u.Config()["log_level"])
+	assert.Equal(t, last.String(), unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata.drupipe.commit"))
+
+	u, err = load(map[string]interface{}{"tag": "v1"}, "configs/root.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "DEBUG", u.Config()["log_level"])
+	assert.Equal(t, first.String(), unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata.drupipe.commit"))
+
+	u, err = load(map[string]interface{}{"commit": first.String(), "subpath": "configs"}, "root.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "DEBUG", u.Config()["log_level"])
+	assert.Equal(t, first.String(), unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata.drupipe.commit"))
+	// Only the subpath checkout has files in its root.
+	files, _ := filepath.Glob(filepath.Join(options.Path, "sources", "*", "root.yaml"))
+	assert.Len(t, files, 1)
+
+	_, err = load(map[string]interface{}{"auth": map[string]interface{}{"type": "token", "token_env": "UNICONF_TEST_UNDEFINED_TOKEN"}}, "configs/root.yaml")
+	assert.EqualError(t, err, `source drupipe: source was not loaded: auth environment variable "UNICONF_TEST_UNDEFINED_TOKEN" is not set`)
+
+	_, err = load(map[string]interface{}{"auth": map[string]interface{}{"type": "ssh"}}, "configs/root.yaml")
+	assert.EqualError(t, err, `source root: entity root: key sources.drupipe: auth: either "key_env" or "key_file" is required`)
+}
+
+// TestSourceRepoConcurrent tests concurrent loading of repo sources declared in config.
+func TestSourceRepoConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_repos")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sources := make(map[string]interface{})
+	for _, name := range []string{"first", "second"} {
+		remote, _, last := prepareTestRepo(t, filepath.Join(dir, name))
+		sources[name] = map[string]interface{}{"type": "repo", "repo": remote, "commit": last.String()}
+	}
+	stdout := os.Stdout
+	u := uniconf.New()
+	u.SetCacheOptions(uniconf.CacheOptions{Path: filepath.Join(dir, "cache")})
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"sources": sources,
+				"from":    []interface{}{"first:configs/root.yaml", "second:configs/root.yaml"},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err = u.Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", u.Config()["log_level"])
+	for name, spec := range sources {
+		commit := spec.(map[string]interface{})["commit"]
+		assert.Equal(t, commit, unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata."+name+".commit"))
+	}
+	assert.True(t, stdout == os.Stdout, "stdout is not restored")
+}
+
+// TestSourceCache tests usage of cached repo sources.
+func TestSourceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, _, last := prepareTestRepo(t, dir)
+	cachePath := filepath.Join(dir, "cache")
+	load := func(spec map[string]interface{}, options uniconf.CacheOptions) (*uniconf.Uniconf, error) {
+		spec["repo"] = remote
+		options.Path = cachePath
+		return loadTestRepoSource(spec, "configs/root.yaml", options)
+	}
+
+	_, err = load(map[string]interface{}{}, uniconf.CacheOptions{})
+	assert.NoError(t, err)
+
+	// Commit to the remote, cached copies are used until they are older than the ttl.
+	workDir := filepath.Join(dir, "work")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(workDir, "configs", "root.yaml"), []byte("log_level: WARN\n"), 0644))
+	work, err := git.PlainOpen(workDir)
+	assert.NoError(t, err)
+	worktree, err := work.Worktree()
+	assert.NoError(t, err)
+	_, err = worktree.Add("configs/root.yaml")
+	assert.NoError(t, err)
+	next, err := worktree.Commit("WARN", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	bare, err := git.PlainOpen(remote)
+	assert.NoError(t, err)
+	assert.NoError(t, bare.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*"}}))
+
+	u, err := load(map[string]interface{}{}, uniconf.CacheOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO", u.Config()["log_level"], "cached copy is used with the default ttl")
+	assert.Equal(t, last.String(), unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata.drupipe.commit"))
+
+	u, err = load(map[string]interface{}{"ttl": "0s"}, uniconf.CacheOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN", u.Config()["log_level"])
+	assert.Equal(t, next.String(), unitool.SearchMapWithPathStringPrefixes(u.Config(), "sources_metadata.drupipe.commit"))
+
+	// Make the remote unavailable, so only cached copies can be used.
+	assert.NoError(t, os.Rename(remote, remote+".moved"))
+
+	u, err = load(map[string]interface{}{"ttl": "1h"}, uniconf.CacheOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN", u.Config()["log_level"])
+
+	u, err = load(map[string]interface{}{}, uniconf.CacheOptions{Offline: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN", u.Config()["log_level"])
+
+	// Stale copy is used if the source can't be fetched.
+	u, err = load(map[string]interface{}{"ttl": "0s"}, uniconf.CacheOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "WARN", u.Config()["log_level"])
+
+	_, err = load(map[string]interface{}{"ttl": "1h"}, uniconf.CacheOptions{Refresh: true})
+	assert.Error(t, err)
+
+	_, err = load(map[string]interface{}{"tag": "v1"}, uniconf.CacheOptions{Offline: true})
+	assert.EqualError(t, err, "source drupipe: source was not loaded: source is not cached and can't be fetched in offline mode")
+}
+
+// TestLockfile tests verification of sources against the lockfile.
+func TestLockfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_lock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, first, _ := prepareTestRepo(t, dir)
+	projectDir := filepath.Join(dir, "project")
+	assert.NoError(t, os.MkdirAll(projectDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "config.yaml"), []byte("name: project\n"), 0644))
+	lockfile := filepath.Join(dir, uniconf.LockfileName)
+
+	load := func(repoSpec map[string]interface{}) *uniconf.Uniconf {
+		repoSpec["type"] = "repo"
+		repoSpec["repo"] = remote
+		u := uniconf.New()
+		u.SetCacheOptions(uniconf.CacheOptions{Path: filepath.Join(dir, "cache")})
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"sources": map[string]interface{}{
+						"drupipe": repoSpec,
+						"project": map[string]interface{}{"type": "file", "path": projectDir},
+					},
+					"from": []interface{}{"drupipe:configs/root.yaml", "project:config.yaml"},
+				},
+			},
+		}))
+		u.SetRootSource("root")
+		_, err := u.Load(nil)
+		assert.NoError(t, err)
+		return u
+	}
+
+	u := load(map[string]interface{}{"tag": "v1"})
+	_, err = u.WriteLockfile([]interface{}{lockfile})
+	assert.NoError(t, err)
+	locked, err := uniconf.ReadLockfile(lockfile)
+	assert.NoError(t, err)
+	assert.Equal(t, first.String(), unitool.SearchMapWithPathStringPrefixes(locked.Sources, "drupipe.commit"))
+
+	_, err = load(map[string]interface{}{"tag": "v1"}).VerifyLockfile([]interface{}{lockfile})
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(projectDir, "config.yaml"), []byte("name: changed\n"), 0644))
+	_, err = load(map[string]interface{}{}).VerifyLockfile([]interface{}{lockfile})
+	if assert.IsType(t, uniconf.Errors{}, err) {
+		errs := err.(uniconf.Errors)
+		assert.Len(t, errs, 3)
+		assert.Equal(t, "drupipe", errs[0].Source)
+		assert.Equal(t, "commit", errs[0].Path)
+		assert.Equal(t, "ref", errs[1].Path)
+		assert.Equal(t, "project", errs[2].Source)
+		assert.Equal(t, "files.config.yaml", errs[2].Path)
+	}
+}
+
+// TestIncludeCycles tests detection of cycles in entity & key "from" references.
+func TestIncludeCycles(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{"from": []interface{}{"project:root"}},
+		},
+	}))
+	u.AddSource(uniconf.NewSourceConfigMap("project", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{"from": []interface{}{"drupipe:helm"}},
+		},
+	}))
+	u.AddSource(uniconf.NewSourceConfigMap("drupipe", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"helm":      map[string]interface{}{"from": []interface{}{"helm/jobs"}},
+			"helm/jobs": map[string]interface{}{"from": []interface{}{"helm"}},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.EqualError(t, err, "source drupipe: entity helm: include cycle: root -> project:root -> drupipe:helm -> drupipe:helm/jobs -> drupipe:helm")
+
+	u = uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+jobs:
+  install:
+    from: .params.a
+params:
+  a:
+    params:
+      from: .params.b
+  b:
+    params:
+      from: .params.a
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load})
+	u.AddPhase(&uniconf.Phase{
+		Name:     "process",
+		Callback: u.ProcessKeys,
+		Args:     []interface{}{"jobs", "", []interface{}{"from_processor"}},
+	})
+	err = u.Execute()
+	if assert.IsType(t, uniconf.Errors{}, err) {
+		e := err.(uniconf.Errors)[0]
+		assert.Equal(t, "jobs.install.from", e.Path)
+		assert.EqualError(t, e.Err, "from cycle: .params.a -> .params.b -> .params.a")
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+from:
+- base:common
+name: project
+jobs:
+  install:
+    level: 2
+`),
+		},
+	}))
+	u.AddSource(uniconf.NewSourceConfigMap("base", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"common": []byte(`
+name: base
+jobs:
+  install:
+    level: 1
+    timeout: 10
+tags: [a, b]
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	provenance, err := u.Explain("jobs.install")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 2) {
+		assert.Equal(t, "jobs.install.level", provenance[0].Path)
+		assert.Equal(t, 2, provenance[0].Value)
+		assert.Equal(t, []unitool.Origin{
+			{Source: "base", EntityID: "common", Line: 5, Column: 5},
+			{Source: "root", EntityID: "root", Line: 7, Column: 5},
+		}, provenance[0].Origins)
+		assert.Equal(t, []unitool.Origin{
+			{Source: "base", EntityID: "common", Line: 6, Column: 5},
+		}, provenance[1].Origins)
+		assert.Equal(t, "jobs.install.level = 2\n  defined in base:common 5:5\n  overridden by root:root 7:5", provenance[0].String())
+	}
+
+	provenance, err = u.Explain("tags.1")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, []unitool.Origin{{Source: "base", EntityID: "common", Line: 7, Column: 11}}, provenance[0].Origins)
+	}
+
+	provenance, err = u.Explain("from_processed.0")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, []unitool.Origin{{Source: "root", EntityID: "root", Line: 3, Column: 3}}, provenance[0].Origins)
+	}
+
+	_, err = u.Explain("jobs.deploy")
+	assert.EqualError(t, err, "key jobs.deploy is not found")
+}
+
+func TestProvenanceAfterProcessKeys(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+entities:
+  job:
+    children_key: jobs
+    retrieve_handler: DeepCollectChildren
+    context_name: job
+    processors: [from_processor]
+jobs:
+  install:
+    from: .params.install
+    image: php
+params:
+  install:
+    params:
+      level: 3
+      context:
+        mode: install
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load})
+	u.AddPhase(&uniconf.Phase{Name: "context", Callback: u.ProcessContext, Args: []interface{}{"job", "install"}})
+	assert.NoError(t, u.Execute())
+
+	provenance, err := u.Explain("jobs.install.level")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, 3, provenance[0].Value)
+		assert.Equal(t, []unitool.Origin{{Source: "root", EntityID: "root", Line: 15, Column: 7}}, provenance[0].Origins)
+	}
+
+	provenance, err = u.Explain("contexts.job.image")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, []unitool.Origin{{Source: "root", EntityID: "root", Line: 11, Column: 5}}, provenance[0].Origins)
+	}
+
+	provenance, err = u.Explain("mode")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, "install", provenance[0].Value)
+		assert.Equal(t, []unitool.Origin{{Source: "root", EntityID: "root", Line: 17, Column: 9}}, provenance[0].Origins)
+	}
+}
+
+func TestListMergeStrategies(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+from:
+- common
+- jobs
+tags: {_merge: prepend, items: [root]}
+webhooks:
+- name: push
+  enabled: true
+`),
+			"common": []byte(`
+tags: [common]
+webhooks:
+- name: push
+  enabled: false
+- name: tag
+`),
+			"jobs": []byte(`
+from:
+- common
+tags: [common, jobs]
+`),
+		},
+	}))
+	u.SetListMergeStrategy("", unitool.ListStrategy{Strategy: unitool.ListUnique})
+	u.SetListMergeStrategy("webhooks", unitool.ListStrategy{Strategy: unitool.ListMergeByKey})
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	config := u.Config()
+	assert.Equal(t, []interface{}{"root", "common", "jobs"}, config["tags"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "push", "enabled": true},
+		map[string]interface{}{"name": "tag"},
+	}, config["webhooks"])
+
+	provenance, err := u.Explain("tags.0")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) {
+		assert.Equal(t, []unitool.Origin{{Source: "root", EntityID: "root", Line: 5, Column: 33}}, provenance[0].Origins)
+	}
+	provenance, err = u.Explain("webhooks.0.enabled")
+	assert.NoError(t, err)
+	if assert.Len(t, provenance, 1) && assert.Len(t, provenance[0].Origins, 2) {
+		assert.Equal(t, "common", provenance[0].Origins[0].EntityID)
+		assert.Equal(t, "root", provenance[0].Origins[1].EntityID)
+	}
+}
+
+func TestMergeDirectives(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+from:
+- base
+settings: {_replace: true, c: 3}
+tags: [!delete a]
+jobs:
+  install:
+    from: .params.job
+    image: !delete
+    labels: {_unset: [team]}
+params:
+  job:
+    params:
+      image: php
+      timeout: 10
+      labels: {team: a, env: dev}
+`),
+			"base": []byte(`
+settings: {a: 1, b: 2}
+tags: [a, b]
+debug: true
+_unset: [debug]
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	u.AddPhase(&uniconf.Phase{Name: "load", Callback: u.Load})
+	u.AddPhase(&uniconf.Phase{Name: "flatten", Callback: u.FlattenConfig})
+	u.AddPhase(&uniconf.Phase{
+		Name:     "process",
+		Callback: u.ProcessKeys,
+		Args:     []interface{}{"jobs", "", []interface{}{"from_processor"}},
+	})
+	assert.NoError(t, u.Execute())
+
+	config := u.Config()
+	assert.Equal(t, map[string]interface{}{"c": 3}, config["settings"])
+	assert.Equal(t, []interface{}{"b"}, config["tags"])
+	assert.Equal(t, true, config["debug"])
+	install := config["jobs"].(map[string]interface{})["install"].(map[string]interface{})
+	assert.NotContains(t, install, "image")
+	assert.Equal(t, 10, install["timeout"])
+	assert.Equal(t, map[string]interface{}{"env": "dev"}, install["labels"])
+	assert.NotContains(t, u.GetYAML(), "!delete")
+}
+
+func TestInputFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_formats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"settings.toml": "name = \"toml\"\n[database]\nport = 5432\nmax_id = 9007199254740993\nratio = 0.5\n",
+		"vars.tfvars":   "region = \"eu-west-1\"\nzones = [\"a\", \"b\"]\nlimit = 10000000\n",
+		"service.conf":  "debug = true\n[http]\nport = 8080\n",
+	}
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"sources": map[string]interface{}{
+					"project": map[string]interface{}{"type": "file", "path": dir},
+				},
+				"from": []interface{}{
+					"project:settings.toml",
+					"project:vars.tfvars",
+					map[string]interface{}{"id": "project:service.conf", "format": "ini"},
+				},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err = u.Load(nil)
+	assert.NoError(t, err)
+
+	config := u.Config()
+	assert.Equal(t, "toml", config["name"])
+	assert.Equal(t, map[string]interface{}{"port": 5432, "max_id": 9007199254740993, "ratio": 0.5}, config["database"])
+	assert.Equal(t, "eu-west-1", config["region"])
+	assert.Equal(t, 10000000, config["limit"])
+	assert.Equal(t, []interface{}{"a", "b"}, config["zones"])
+	assert.Equal(t, "true", config["debug"])
+	assert.Equal(t, map[string]interface{}{"port": "8080"}, config["http"])
+}
+
+func TestOutputFormats(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"app": map[string]interface{}{"name": "demo", "tags": []interface{}{"a", "b"}},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	output, err := u.Output("dotenv", unitool.EncodeOptions{Prefix: "ci."})
+	assert.NoError(t, err)
+	assert.Contains(t, output, "CI_APP_NAME=demo\n")
+	output, err = u.Output("properties", unitool.EncodeOptions{Separator: "/"})
+	assert.NoError(t, err)
+	assert.Contains(t, output, "app/name=demo\n")
+	assert.Equal(t, u.GetJSON(), mustOutput(t, u, "json"))
+	assert.Equal(t, u.GetYAML(), mustOutput(t, u, "yaml"))
+
+	_, err = u.Output("xml", unitool.EncodeOptions{})
+	assert.Error(t, err)
+	_, err = u.PrintConfig([]interface{}{"app", "xml"})
+	assert.Error(t, err)
+	_, err = u.PrintConfig([]interface{}{"app", "shell", map[string]interface{}{"key_case": "lower"}})
+	assert.NoError(t, err)
+}
+
+func mustOutput(t *testing.T, u *uniconf.Uniconf, format string) string {
+	output, err := u.Output(format, unitool.EncodeOptions{})
+	assert.NoError(t, err)
+	return output
+}
+
+func TestUnmarshal(t *testing.T) {
+	type database struct {
+		Host    string        `uniconf:"host"`
+		Port    int           `uniconf:"port" default:"5432"`
+		Timeout time.Duration `uniconf:"timeout" default:"30s"`
+		Created time.Time     `uniconf:"created"`
+	}
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+services:
+  db:
+    host: localhost
+    timeout: 1m
+    created: 2018-01-02T03:04:05Z
+    extra: true
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	var db database
+	assert.NoError(t, u.Unmarshal("services.db", &db))
+	assert.Equal(t, database{
+		Host:    "localhost",
+		Port:    5432,
+		Timeout: time.Minute,
+		Created: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, db)
+
+	u.SetStrictUnmarshal(true)
+	err = u.Unmarshal("services.db", &database{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown keys: services.db.extra")
+	}
+	assert.Error(t, u.Unmarshal("services.cache", &database{}))
+
+	var context interface{} = u.Config()["services"].(map[string]interface{})["db"]
+	_, err = u.SetContext([]interface{}{"db", &context})
+	assert.NoError(t, err)
+	u.SetStrictUnmarshal(false)
+	db = database{}
+	assert.NoError(t, u.UnmarshalContext("db", &db))
+	assert.Equal(t, "localhost", db.Host)
+	assert.Error(t, u.UnmarshalContext("cache", &db))
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_schemas")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "schemas.yaml"), []byte("schemas:\n  jobs.*: job.json\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "job.json"), []byte(`{
+  "type": "object",
+  "required": ["image"],
+  "properties": {"image": {"type": "string"}, "timeout": {"type": "integer"}}
+}`), 0644))
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+sources:
+  project: {type: file, path: ` + dir + `}
+from: [jobs, "project:schemas.yaml"]
+schemas:
+  jbos.*: {type: object}
+  settings:
+    type: object
+    additionalProperties: false
+    properties: {debug: {type: boolean}}
+settings: {debug: true}
+`),
+			"jobs": []byte(`
+jobs:
+  build: {image: golang}
+  install: {timeout: ten}
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err = u.Load(nil)
+	assert.NoError(t, err)
+
+	_, err = u.Validate(nil)
+	errs, ok := err.(uniconf.Errors)
+	if assert.True(t, ok, "%v", err) && assert.Len(t, errs, 3) {
+		assert.Equal(t, "schemas.jbos.*", errs[0].Path)
+		assert.Equal(t, "jobs.install.image", errs[1].Path)
+		assert.Equal(t, "jobs.install.timeout", errs[2].Path)
+		assert.Equal(t, "root", errs[2].Source)
+		assert.Equal(t, "jobs", errs[2].EntityID)
+	}
+	_, err = u.Validate([]interface{}{"settings"})
+	assert.NoError(t, err)
+	_, err = u.Validate([]interface{}{"jbos.*"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "schemas.jbos.*: key doesn't match any config values")
+	}
+	_, err = u.Validate([]interface{}{"settings", "setings"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "schemas.setings: schema is not declared")
+	}
+
+	u.AddPhase(&uniconf.Phase{Name: "validate", Callback: u.Validate})
+	err = u.Execute()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "key jobs.install.timeout")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_secrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "db"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "db", "prod.yaml"), []byte("password: file-pass\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "prod.enc.yaml"), testSopsYaml, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "age.key"), []byte(testSopsAgeKey), 0600))
+	os.Setenv("UNICONF_TEST_DB_PROD_PASSWORD", "env-pass")
+	defer os.Unsetenv("UNICONF_TEST_DB_PROD_PASSWORD")
+	os.Setenv("UNICONF_TEST_DB_PROD_USER", "admin")
+	defer os.Unsetenv("UNICONF_TEST_DB_PROD_USER")
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"secrets": map[string]interface{}{
+					"default": map[string]interface{}{"type": "file", "path": dir},
+					"env":     map[string]interface{}{"type": "env", "prefix": "UNICONF_TEST_"},
+					"sops":    map[string]interface{}{"type": "sops", "path": filepath.Join(dir, "prod.enc.yaml"), "key_file": filepath.Join(dir, "age.key")},
+				},
+				"db": map[string]interface{}{
+					"password": `${secret("db/prod#password")}`,
+					"url":      `postgres://app:${secret("env:db/prod#password")}@${host}`,
+					"sops":     `${secret("sops:db/prod#password")}`,
+					"user":     `${secret("env:db/prod#user")}`,
+				},
+				"token": []interface{}{`${secret("token")}`},
+				"dsn":   "${db.user}:${db.password}@${name}",
+				"name":  "admin",
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err = u.Load(nil)
+	assert.NoError(t, err)
+	_, err = u.Resolve([]interface{}{"dsn"})
+	assert.NoError(t, err)
+
+	// Processors see secret references, secrets aren't stored in config.
+	values := make([]string, 0)
+	_, err = u.ProcessKeys([]interface{}{"", "", []*uniconf.Processor{{
+		Callback: func(source interface{}, path string, phase *uniconf.Phase) (interface{}, bool, bool, bool, interface{}, error) {
+			values = append(values, source.(string))
+			return nil, false, false, false, nil, nil
+		},
+	}}})
+	assert.NoError(t, err)
+	assert.Contains(t, values, `${secret("db/prod#password")}`)
+	assert.Contains(t, values, "${db.user}:${db.password}@admin")
+	for _, value := range values {
+		assert.NotContains(t, value, "-pass")
+	}
+
+	config := u.Config()
+	db := config["db"].(map[string]interface{})
+	assert.Equal(t, "file-pass", db["password"])
+	assert.Equal(t, "postgres://app:env-pass@${host}", db["url"])
+	assert.Equal(t, "sops-pass", db["sops"])
+	assert.Equal(t, []interface{}{"file-token"}, config["token"])
+	assert.Equal(t, "admin:file-pass@admin", config["dsn"])
+
+	for _, output := range []string{u.GetYAML(), u.GetJSON(), mustOutput(t, u, "dotenv")} {
+		for _, secret := range []string{"file-pass", "env-pass", "sops-pass", "file-token"} {
+			assert.NotContains(t, output, secret)
+		}
+		assert.Contains(t, output, uniconf.RedactedSecret)
+	}
+	// Values are redacted by their interpolations, equal values which aren't secrets are kept.
+	assert.Contains(t, u.GetYAML(), "name: admin")
+	assert.Contains(t, u.GetYAML(), "dsn: '[REDACTED]:[REDACTED]@admin'")
+	provenance, err := u.Explain("db.password")
+	assert.NoError(t, err)
+	assert.Equal(t, uniconf.RedactedSecret, provenance[0].Value)
+
+	var out struct {
+		DB struct {
+			Password string `uniconf:"password"`
+		} `uniconf:"db"`
+	}
+	assert.NoError(t, u.Unmarshal("", &out))
+	assert.Equal(t, "file-pass", out.DB.Password)
+
+	value, err := u.InterpolateString(`${secret("env:db/prod#password")}`, map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, "env-pass", value)
+
+	u.SetRevealSecrets(true)
+	assert.Contains(t, u.GetYAML(), "sops-pass")
+
+	_, err = u.InterpolateString(`${secret("vault:db")}`, map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestInterpolationFunctions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uniconf_functions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte("jobs:\n  install:\n    script: ${file(\"install.sh\")}\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "install.sh"), []byte("make install"), 0644))
+	os.Setenv("UNICONF_TEST_FUNCTION", "set")
+	defer os.Unsetenv("UNICONF_TEST_FUNCTION")
+	uniconf.RegisterFunction("greet", ast.Function{
+		ArgTypes:   []ast.Type{ast.TypeString},
+		ReturnType: ast.TypeString,
+		Callback: func(inputs []interface{}) (interface{}, error) {
+			return "hello " + inputs[0].(string), nil
+		},
+	})
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"sources": map[string]interface{}{
+					"project": map[string]interface{}{"type": "file", "path": dir},
+				},
+				"from": []interface{}{"project:config.yaml"},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err = u.Load(nil)
+	assert.NoError(t, err)
+
+	vars := map[string]interface{}{
+		"name":   "Demo App",
+		"empty":  "",
+		"none":   nil,
+		"tags":   []interface{}{"a", "b"},
+		"labels": map[string]interface{}{"team": "x", "env": "dev"},
+	}
+	tests := map[string]string{
+		`${default(empty, "fallback")}`:                    "fallback",
+		`${default(name, "fallback")}`:                     "Demo App",
+		`${coalesce(empty, "", "first", "second")}`:        "first",
+		`${default(missing, "fallback")}`:                  "fallback",
+		`${default(deepGet("missing.key"), "fallback")}`:   "fallback",
+		`${default(none, "fallback")}`:                     "fallback",
+		`${coalesce(missing, none, "first")}`:              "first",
+		`${lower(name)}-${upper(name)}`:                    "demo app-DEMO APP",
+		`${replace(name, " ", "_")}`:                       "Demo_App",
+		`${regex_replace(name, "[aeiou]", "")}`:            "Dm App",
+		`${join(",", tags)}`:                               "a,b",
+		`${join("+", split(",", "x,y,z"))}`:                "x+y+z",
+		`${base64decode(base64encode(name))}`:              "Demo App",
+		`${sha256("abc")}`:                                 "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		`${json_encode(labels)}`:                           `{"env":"dev","team":"x"}`,
+		`${yaml_encode(tags)}`:                             "- a\n- b\n",
+		`${join(",", keys(labels))}`:                       "env,team",
+		`${join(",", values(labels))}`:                     "dev,x",
+		`${env_or("UNICONF_TEST_FUNCTION", "unset")}`:      "set",
+		`${env_or("UNICONF_TEST_FUNCTION_NONE", "unset")}`: "unset",
+		`${greet(name)}`:                                   "hello Demo App",
+	}
+	for input, expected := range tests {
+		result, err := u.InterpolateString(input, vars)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, result, input)
+	}
+
+	script := u.Config()["jobs"].(map[string]interface{})["install"].(map[string]interface{})["script"].(string)
+	result, _, _, _, _, err := u.InterpolateProcess(script, ".jobs.install.script", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "make install", result)
+
+	_, err = u.InterpolateString(`${regex_replace(name, "[", "")}`, vars)
+	assert.Error(t, err)
+
+	// Only arguments preceding fallbacks may be undefined.
+	for _, input := range []string{`${default(name, missing)}`, `${missing}-${default(missing, "x")}`, `${lower(missing)}`} {
+		_, err = u.InterpolateString(input, vars)
+		if assert.Error(t, err, input) {
+			assert.Contains(t, err.Error(), "undefined references: missing", input)
+		}
+	}
+}
+
+func TestTypedInterpolation(t *testing.T) {
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": map[string]interface{}{
+				"params":   map[string]interface{}{"image": "nginx", "port": 8080},
+				"released": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				"service": map[string]interface{}{
+					"version":  "v ${released}",
+					"released": `${deepGet("released")}`,
+					"port":     "${params.port}",
+					"params":   `${deepGet("params")}`,
+					"url":      "http://localhost:${params.port}/${deepGet(\"params.image\")}",
+					"ports":    []interface{}{"${params.port}", "${params.port}1"},
+				},
+			},
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	value, err := u.Interpolate("${params.port}", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8080, value)
+	s, err := u.InterpolateString("${params.port}", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "8080", s)
+	s, err = u.InterpolateString("${released}", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "2020-01-01T00:00:00Z", s)
+	_, err = u.InterpolateString(`${deepGet("params")}`, nil)
+	assert.Error(t, err)
+	_, err = u.InterpolateString(`image: ${deepGet("params")}`, nil)
+	assert.Error(t, err)
+
+	_, err = u.ProcessKeys([]interface{}{"service", "", []*uniconf.Processor{{Callback: u.InterpolateProcess}}})
+	assert.NoError(t, err)
+	service := u.Config()["service"].(map[string]interface{})
+	assert.Equal(t, 8080, service["port"])
+	assert.Equal(t, map[string]interface{}{"image": "nginx", "port": 8080}, service["params"])
+	assert.Equal(t, "http://localhost:8080/nginx", service["url"])
+	assert.Equal(t, []interface{}{8080, "80801"}, service["ports"])
+	assert.Equal(t, "v 2020-01-01T00:00:00Z", service["version"])
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), service["released"])
+}
+
+func TestResolve(t *testing.T) {
+	newUniconf := func(config map[string]interface{}) *uniconf.Uniconf {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{"root": config},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		_, err := u.Load(nil)
+		assert.NoError(t, err)
+		return u
+	}
+
+	u := newUniconf(map[string]interface{}{
+		"url":  "http://${host}:${port}",
+		"host": "${domain[0]}",
+		"port": "${params.port}",
+		"params": map[string]interface{}{
+			"port":    8080,
+			"domains": []interface{}{"${name}.example.com"},
+		},
+		"domain": `${deepGet("params.domains")}`,
+		"name":   "app",
+		"job":    map[string]interface{}{"endpoint": "${url}/${name}"},
+	})
+	_, err := u.Resolve([]interface{}{"job"})
+	assert.NoError(t, err)
+	config := u.Config()
+	assert.Equal(t, "http://app.example.com:8080/app", config["job"].(map[string]interface{})["endpoint"])
+	assert.Equal(t, []interface{}{"app.example.com"}, config["domain"])
+	assert.Equal(t, 8080, config["port"])
+
+	u = newUniconf(map[string]interface{}{
+		"a":     "${b}",
+		"b":     map[string]interface{}{"c": "${d}"},
+		"d":     "${a}",
+		"e":     "${a}-e",
+		"f":     "${missing}",
+		"g":     "static",
+		"h":     "${g}",
+		"self":  map[string]interface{}{"x": "${self}"},
+		"other": "${f}",
+	})
+	_, err = u.Resolve(nil)
+	errs, ok := err.(uniconf.Errors)
+	if assert.True(t, ok, "%v", err) {
+		messages := make(map[string]string)
+		for _, e := range errs {
+			messages[e.Path] = e.Err.Error()
+		}
+		assert.Len(t, messages, 3)
+		assert.Equal(t, "interpolation cycle: a -> b.c -> d -> a", messages["a"])
+		assert.Equal(t, "interpolation cycle: self.x -> self.x", messages["self.x"])
+		assert.Contains(t, messages["f"], "missing")
+		assert.Equal(t, "root", errs[0].Source)
+	}
+	config = u.Config()
+	assert.Equal(t, "static", config["h"])
+	assert.Equal(t, "${a}-e", config["e"])
+	assert.Equal(t, "${f}", config["other"])
+}
+
+func TestUndefinedReferences(t *testing.T) {
+	newUniconf := func() *uniconf.Uniconf {
+		u := uniconf.New()
+		u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+			"configMap": map[string]interface{}{
+				"root": map[string]interface{}{
+					"name":    "app",
+					"port":    8080,
+					"version": "${name}-${GIT_COMMIT}",
+					"url":     "${host}:${port}",
+					"path":    "${deepGet(\"paths.root\")}/${name}",
+					"literal": `$${secret("db#password")}`,
+					"quoted":  `${name}: $${secret("db#password")}`,
+				},
+			},
+		}))
+		assert.NoError(t, u.SetRootSource("root"))
+		_, err := u.Load(nil)
+		assert.NoError(t, err)
+		return u
+	}
+	u := newUniconf()
+	assert.Error(t, u.SetUndefinedMode("unknown"))
+
+	_, err := u.InterpolateString(`${a}-${b}-${deepGet("c.d")}-${a}-${name}`, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "undefined references: a, b, c.d")
+	}
+	_, err = u.Resolve(nil)
+	errs, ok := err.(uniconf.Errors)
+	if assert.True(t, ok, "%v", err) {
+		paths := make([]string, 0)
+		for _, e := range errs {
+			paths = append(paths, e.Path)
+		}
+		assert.ElementsMatch(t, []string{"version", "url", "path"}, paths)
+	}
+	assert.Equal(t, `${secret("db#password")}`, u.Config()["literal"])
+
+	tests := map[string]map[string]interface{}{
+		uniconf.UndefinedKeep: {
+			"${name}-${GIT_COMMIT}":  "app-${GIT_COMMIT}",
+			"${GIT_COMMIT}":          "${GIT_COMMIT}",
+			"${lower(GIT_COMMIT)}":   "${lower(GIT_COMMIT)}",
+			"${port}":                8080,
+			"$${name} ${GIT_COMMIT}": "${name} ${GIT_COMMIT}",
+		},
+		uniconf.UndefinedEmpty: {
+			"${name}-${GIT_COMMIT}":  "app-",
+			"${GIT_COMMIT}":          "",
+			"$${name} ${GIT_COMMIT}": "${name} ",
+		},
+		uniconf.UndefinedStrict: {
+			"$${name} ${name}": "${name} app",
+			"$${GIT_COMMIT}":   "${GIT_COMMIT}",
+		},
+	}
+	for mode, inputs := range tests {
+		assert.NoError(t, u.SetUndefinedMode(mode))
+		for input, expected := range inputs {
+			value, err := u.Interpolate(input, nil)
+			assert.NoError(t, err, input)
+			assert.Equal(t, expected, value, mode+": "+input)
+		}
+	}
+
+	u = newUniconf()
+	assert.NoError(t, u.SetUndefinedMode(uniconf.UndefinedKeep))
+	_, err = u.Resolve(nil)
+	assert.NoError(t, err)
+	config := u.Config()
+	assert.Equal(t, "app-${GIT_COMMIT}", config["version"])
+	assert.Equal(t, "${host}:8080", config["url"])
+	assert.Equal(t, `${deepGet("paths.root")}/app`, config["path"])
+	assert.Equal(t, `${secret("db#password")}`, config["literal"])
+	assert.Equal(t, `app: ${secret("db#password")}`, config["quoted"])
+
+	// Escapes are kept in config, so interpolated values aren't evaluated again.
+	u = newUniconf()
+	store := testSecretStore{}
+	u.AddSecretStore(uniconf.DefaultSecretStore, store)
+	assert.NoError(t, u.SetUndefinedMode(uniconf.UndefinedKeep))
+	for i := 0; i < 2; i++ {
+		_, err = u.Resolve(nil)
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, store)
+	assert.Equal(t, `app: ${secret("db#password")}`, u.Config()["quoted"])
+	assert.Contains(t, u.GetYAML(), `quoted: 'app: ${secret("db#password")}'`)
+
+	// Processing keys reports all values which failed to be interpolated like Resolve does.
+	u = newUniconf()
+	_, err = u.ProcessKeys([]interface{}{"", "", []interface{}{"interpolate"}})
+	errs, ok = err.(uniconf.Errors)
+	if assert.True(t, ok, "%v", err) {
+		paths := make([]string, 0)
+		for _, e := range errs {
+			paths = append(paths, e.Path)
+			assert.Equal(t, "root", e.Source)
+		}
+		assert.ElementsMatch(t, []string{"version", "url", "path"}, paths)
+	}
+	assert.Equal(t, `app: ${secret("db#password")}`, u.Config()["quoted"])
+}
+
+// testSecretStore counts requested secrets.
+type testSecretStore map[string]int
+
+func (s testSecretStore) Secret(path, field string) (string, error) {
+	s[path+"#"+field]++
+	return "secret", nil
+}
+
+func TestProcessorRegistry(t *testing.T) {
+	os.Setenv("UNICONF_TEST_IMAGE", "alpine:edge")
+	defer os.Unsetenv("UNICONF_TEST_IMAGE")
+	// env_defaults replaces values with environment variables named by their keys if they are set.
+	uniconf.RegisterProcessor("env_defaults", func(u *uniconf.Uniconf, options map[string]interface{}) (*uniconf.Processor, error) {
+		prefix, _ := options["prefix"].(string)
+		return &uniconf.Processor{
+			Callback: func(source interface{}, path string, phase *uniconf.Phase) (interface{}, bool, bool, bool, interface{}, error) {
+				parts := strings.Split(path, ".")
+				if value, ok := os.LookupEnv(prefix + strings.ToUpper(parts[len(parts)-1])); ok {
+					return value, true, false, false, nil, nil
+				}
+				return nil, false, false, false, nil, nil
+			},
+		}, nil
+	})
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+project: demo
+entities:
+  job:
+    retrieve_handler: DeepCollectChildren
+    children_key: jobs
+    context_name: job
+    processors:
+    - from_processor
+    - {name: interpolate, exclude_keys: [script]}
+    - {name: env_defaults, prefix: UNICONF_TEST_, include_keys: [image]}
+jobs:
+  build:
+    from: .params.job
+    name: ${project}-build
+    script: echo ${project}
+params:
+  job:
+    params:
+      image: alpine
+      tag: ${project}
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	job, err := u.ProcessContext([]interface{}{"job", "build"})
+	assert.NoError(t, err)
+	assert.Equal(t, "demo-build", job.(map[string]interface{})["name"])
+	assert.Equal(t, "echo ${project}", job.(map[string]interface{})["script"])
+	assert.Equal(t, "alpine:edge", job.(map[string]interface{})["image"])
+	assert.Equal(t, "demo", job.(map[string]interface{})["tag"])
+
+	_, err = u.ProcessKeys([]interface{}{"jobs", "", []interface{}{"unknown"}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown processor: unknown")
+	}
+	_, err = u.ProcessKeys([]interface{}{"jobs", "", []interface{}{map[string]interface{}{"name": "interpolate", "include_keys": "script"}}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "processor interpolate: include_keys: keys should be a list")
+	}
+	_, err = u.ProcessKeys([]interface{}{"jobs", "", []interface{}{"interpolate"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "echo demo", u.Config()["jobs"].(map[string]interface{})["build"].(map[string]interface{})["script"])
+	_, err = u.ProcessKeys([]interface{}{"jobs", "", []string{"interpolate"}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "jobs: processors should be a list, got []string")
+	}
+}
+
+func TestProcessorReadsConfig(t *testing.T) {
+	// project_prefix prefixes values with the project read through exported methods of the instance.
+	uniconf.RegisterProcessor("project_prefix", func(u *uniconf.Uniconf, options map[string]interface{}) (*uniconf.Processor, error) {
+		return &uniconf.Processor{
+			IncludeKeys: []string{"name"},
+			Callback: func(source interface{}, path string, phase *uniconf.Phase) (interface{}, bool, bool, bool, interface{}, error) {
+				if _, ok := u.Config()["project"]; !ok {
+					return nil, false, false, false, nil, nil
+				}
+				prefix, err := u.InterpolateString("${project}-", nil)
+				if err != nil {
+					return nil, false, false, false, nil, err
+				}
+				if strings.HasPrefix(source.(string), prefix) {
+					return nil, false, false, false, nil, nil
+				}
+				return prefix + source.(string), true, false, false, nil, nil
+			},
+		}, nil
+	})
+
+	u := uniconf.New()
+	u.AddSource(uniconf.NewSourceConfigMap("root", map[string]interface{}{
+		"configMap": map[string]interface{}{
+			"root": []byte(`
+project: demo
+entities:
+  job:
+    retrieve_handler: DeepCollectChildren
+    children_key: jobs
+    context_name: job
+    processors: [project_prefix]
+jobs:
+  build:
+    name: build
+`),
+		},
+	}))
+	assert.NoError(t, u.SetRootSource("root"))
+	_, err := u.Load(nil)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		if _, err := u.ProcessKeys([]interface{}{"jobs", "", []interface{}{"project_prefix"}}); err != nil {
+			done <- err
+			return
+		}
+		_, err := u.ProcessContext([]interface{}{"job", "build"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("processor reading config deadlocked")
+	}
+	assert.Equal(t, "demo-build", u.Config()["jobs"].(map[string]interface{})["build"].(map[string]interface{})["name"])
+}
+
 func AreEqualInterfaces(i1, i2 interface{}) (bool, error) {
 	return checkers.DeepEqual(i1, i2)
 }
@@ -1350,3 +3201,24 @@ projects:
     from:
     - .mothership.project.type1
 `)
+
+const testSopsAgeKey = "AGE-SECRET-KEY-1YW7KYMYU28AC8SG3V5KYW9DMXYJS5XKJAFRKTTQQ3VLMAYCKD05SSNUDPP"
+
+var testSopsYaml = []byte(`db:
+  prod:
+    password: ENC[AES256_GCM,data:hUX8OgTFjZ5h,iv:PAGwmX2Yh0484n6t20wlkuosuYFfDFbaiCVUEo2+qdg=,tag:PViKCRu1P+c7CVTy2HWCMQ==,type:str]
+sops:
+  age:
+  - enc: |
+      -----BEGIN AGE ENCRYPTED FILE-----
+      YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBYM3poYmRYaWZYSDArQzBi
+      UUhQcE1yaG9GQ0JhSmNpTU5WSjUxOVdqeEhzCktEVmVXRktRVmovbTc0TDZXUWNr
+      c1NXTFdKaFNNOVNqbTE3MmVyUWVIREUKLS0tIGlWUnJLV2kwL04xZkVoOHpFS0JU
+      QXRMZUVuMkdDYS9wS1pZQThKakc3Um8KtCh4cJag31CxMpXOEC1p6QtfRrWiaAgE
+      xC0NfsCPemwKADi/Twlssya87MJFRdcW6h+hvyYxnmVlVBWYYSoT4Q==
+      -----END AGE ENCRYPTED FILE-----
+    recipient: age1cz9xd2pz4mm329j3m6dyarx47aal03evuwgpqt7ygqglhyf6v3cqkfms4m
+  lastmodified: "2024-01-02T03:04:05Z"
+  mac: ENC[AES256_GCM,data:jSMC8XpiUtpSX/hUV1ikl+EOEPep0IEgGSoH6HaYEWJyRKohPTrtwwvDyYiKw/55J1836r52fEWspyMaIoIHbPnnAQwdpH46RBwH/f+Y6uSca3N2OjenUbD4xXn/eI8d7itrVpuEa5Dej1Y2aYB5VYqITD71zaXO7pWIQpVWpi8=,iv:+Svt/yYJkwDD7LYCHUWgh24rRIVSpilCVUR/Rc/FRes=,tag:tbTyIeH7Mjb0T1vG5fXq6Q==,type:str]
+  unencrypted_suffix: _unencrypted
+`)
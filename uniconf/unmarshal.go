@@ -0,0 +1,62 @@
+package uniconf
+
+import (
+	"fmt"
+
+	"github.com/aroq/uniconf/unitool"
+)
+
+func Unmarshal(path string, out interface{}) error { return u.Unmarshal(path, out) }
+
+// Unmarshal decodes the config subtree by the dotted path into out, e.g. a pointer to a struct,
+// the whole config is decoded if the path is empty. See unitool.Decode for supported struct tags.
+func (u *Uniconf) Unmarshal(path string, out interface{}) error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.revealedConfig()
+	if err != nil {
+		return err
+	}
+	var value interface{} = config
+	if path != "" {
+		if value = unitool.SearchMapWithPathStringPrefixes(config, path); value == nil {
+			return fmt.Errorf("key %s is not found", path)
+		}
+	}
+	return u.decode(value, path, out)
+}
+
+func UnmarshalContext(name string, out interface{}) error { return u.UnmarshalContext(name, out) }
+
+// UnmarshalContext decodes the context set by ProcessContext or SetContext into out.
+func (u *Uniconf) UnmarshalContext(name string, out interface{}) error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	config, err := u.revealedConfig()
+	if err != nil {
+		return err
+	}
+	contexts, _ := config["contexts"].(map[string]interface{})
+	context, ok := contexts[name]
+	if !ok {
+		return fmt.Errorf("context %s is not found", name)
+	}
+	return u.decode(context, "contexts."+name, out)
+}
+
+func (u *Uniconf) decode(value interface{}, path string, out interface{}) error {
+	err := unitool.Decode(value, out, unitool.DecodeOptions{Strict: u.strictUnmarshal, Path: path})
+	if err != nil {
+		return &Error{Path: path, Err: err}
+	}
+	return nil
+}
+
+func SetStrictUnmarshal(strict bool) { u.SetStrictUnmarshal(strict) }
+
+// SetStrictUnmarshal makes config keys which don't match struct fields errors of Unmarshal & UnmarshalContext.
+func (u *Uniconf) SetStrictUnmarshal(strict bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.strictUnmarshal = strict
+}
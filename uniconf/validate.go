@@ -0,0 +1,127 @@
+package uniconf
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aroq/uniconf/unitool"
+)
+
+// SchemasElementName is the config key mapping key paths to JSON Schemas, e.g. "schemas: {jobs.*: ./schemas/job.json}".
+const SchemasElementName = "schemas"
+
+func Validate(inputs []interface{}) (interface{}, error) { return u.Validate(inputs) }
+
+// Validate validates config values against JSON Schemas declared in the "schemas" key. Schemas are file paths, URLs
+// or inline schema documents, relative paths are relative to the source declaring them. Schema keys are dotted paths
+// where "*" matches any key, e.g. "jobs.*" or "contexts.job".
+// Optional inputs are keys of schemas to validate, all schemas are validated by default. Keys which match no config
+// values and inputs which aren't declared schema keys are reported as errors.
+// Errors have key paths of offending values & sources and entities which set them.
+func (u *Uniconf) Validate(inputs []interface{}) (interface{}, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	definition, ok := u.config[SchemasElementName]
+	if !ok && len(inputs) == 0 {
+		return nil, nil
+	}
+	schemas, ok := definition.(map[string]interface{})
+	if !ok && definition != nil {
+		return nil, &Error{Path: SchemasElementName, Err: fmt.Errorf("schemas should be a map, got %T", definition)}
+	}
+	errs := make(Errors, 0)
+	for _, input := range inputs {
+		if _, ok := schemas[fmt.Sprint(input)]; !ok {
+			errs = append(errs, &Error{Path: SchemasElementName + "." + fmt.Sprint(input), Err: errors.New("schema is not declared")})
+		}
+	}
+	patterns := make([]string, 0, len(schemas))
+	for pattern := range schemas {
+		if len(inputs) == 0 || containsInput(inputs, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	config, err := u.revealedConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		schema := schemas[pattern]
+		// Relative schema paths are resolved against the path of the source declaring them like file() paths.
+		if s, ok := schema.(string); ok && !strings.Contains(s, "://") && !filepath.IsAbs(s) {
+			schema = filepath.Join(u.sourcePathOf(SchemasElementName+"."+pattern), s)
+		}
+		values := unitool.SelectPaths(config, pattern)
+		if len(values) == 0 {
+			errs = append(errs, &Error{Path: SchemasElementName + "." + pattern, Err: errors.New("key doesn't match any config values")})
+			continue
+		}
+		paths := make([]string, 0, len(values))
+		for path := range values {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			schemaErrors, err := unitool.ValidateSchema(values[path], path, schema)
+			if err != nil {
+				errs = append(errs, &Error{Path: SchemasElementName + "." + pattern, Err: err})
+				break
+			}
+			for _, e := range schemaErrors {
+				err := &Error{Path: e.Path, Err: errors.New(e.Message)}
+				if origin, ok := u.originOf(e.Path); ok {
+					err.Source, err.EntityID = origin.Source, origin.EntityID
+				}
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
+
+func containsInput(inputs []interface{}, value string) bool {
+	for _, input := range inputs {
+		if fmt.Sprint(input) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// originOf returns the effective origin of the value at the path, or of its nested values or parents
+// if the value itself is a map, a list or is missing.
+func (u *Uniconf) originOf(path string) (unitool.Origin, bool) {
+	for {
+		subtree := u.origins.Subtree(path)
+		if origins := subtree[""]; len(origins) > 0 {
+			return origins[len(origins)-1], true
+		}
+		keys := make([]string, 0, len(subtree))
+		for k, origins := range subtree {
+			if len(origins) > 0 {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			origins := subtree[keys[0]]
+			return origins[len(origins)-1], true
+		}
+		if path == "" {
+			return unitool.Origin{}, false
+		}
+		if i := strings.LastIndex(path, "."); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+}
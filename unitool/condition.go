@@ -0,0 +1,186 @@
+package unitool
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EvalCondition evaluates conditions like "environment == prod && !debug".
+// Conditions support ==, !=, &&, || & ! operators, parentheses & quoted strings.
+// Identifiers are resolved with lookup, unresolved ones are errors. Unquoted right-hand operands of comparisons,
+// numbers, true & false are literals, e.g. "environment == prod" compares the environment value with "prod".
+// Values are compared as strings, single values are true unless they are empty, "false" or "0".
+func EvalCondition(condition string, lookup func(name string) (interface{}, bool)) (bool, error) {
+	tokens, err := conditionTokens(condition)
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %v", condition, err)
+	}
+	p := &conditionParser{tokens: tokens, lookup: lookup}
+	result, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %v", condition, err)
+	}
+	return truthy(result), nil
+}
+
+type conditionToken struct {
+	text   string
+	quoted bool
+}
+
+func conditionTokens(condition string) ([]conditionToken, error) {
+	tokens := make([]conditionToken, 0)
+	runes := []rune(condition)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, conditionToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		case strings.HasPrefix(string(runes[i:]), "==") || strings.HasPrefix(string(runes[i:]), "!=") ||
+			strings.HasPrefix(string(runes[i:]), "&&") || strings.HasPrefix(string(runes[i:]), "||"):
+			tokens = append(tokens, conditionToken{text: string(runes[i : i+2])})
+			i += 2
+		case r == '!' || r == '(' || r == ')':
+			tokens = append(tokens, conditionToken{text: string(r)})
+			i++
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("\"'=!&|()", runes[end]) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected %q", string(r))
+			}
+			tokens = append(tokens, conditionToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+	lookup func(name string) (interface{}, bool)
+}
+
+func (p *conditionParser) operator(op string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) or() (interface{}, error) {
+	left, err := p.and()
+	for err == nil && p.operator("||") {
+		var right interface{}
+		if right, err = p.and(); err == nil {
+			left = truthy(left) || truthy(right)
+		}
+	}
+	return left, err
+}
+
+func (p *conditionParser) and() (interface{}, error) {
+	left, err := p.comparison()
+	for err == nil && p.operator("&&") {
+		var right interface{}
+		if right, err = p.comparison(); err == nil {
+			left = truthy(left) && truthy(right)
+		}
+	}
+	return left, err
+}
+
+func (p *conditionParser) comparison() (interface{}, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.operator(op) {
+			var right interface{}
+			if token, ok := p.literal(); ok {
+				right = token
+			} else if right, err = p.unary(); err != nil {
+				return nil, err
+			}
+			equal := fmt.Sprint(left) == fmt.Sprint(right)
+			return equal == (op == "=="), nil
+		}
+	}
+	return left, nil
+}
+
+// literal consumes the next token if it is a plain word, e.g. an unquoted right-hand operand.
+func (p *conditionParser) literal() (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	token := p.tokens[p.pos]
+	if token.quoted || strings.ContainsAny(token.text, "=!&|()") {
+		return "", false
+	}
+	p.pos++
+	return token.text, true
+}
+
+func (p *conditionParser) unary() (interface{}, error) {
+	if p.operator("!") {
+		value, err := p.unary()
+		return !truthy(value), err
+	}
+	if p.operator("(") {
+		value, err := p.or()
+		if err == nil && !p.operator(")") {
+			err = fmt.Errorf("missing )")
+		}
+		return value, err
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	if !token.quoted && strings.ContainsAny(token.text, "=!&|()") {
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+	p.pos++
+	if token.quoted || token.text == "true" || token.text == "false" {
+		return token.text, nil
+	}
+	if _, err := strconv.ParseFloat(token.text, 64); err == nil {
+		return token.text, nil
+	}
+	if value, ok := p.lookup(token.text); ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown identifier %q", token.text)
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	s := fmt.Sprint(value)
+	return s != "" && s != "false" && s != "0"
+}
@@ -0,0 +1,120 @@
+package unitool
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Struct tags used by Decode, e.g. `uniconf:"port" default:"8080"`.
+const (
+	DecodeTagName  = "uniconf"
+	DefaultTagName = "default"
+)
+
+// DecodeOptions control decoding of config values into Go values.
+type DecodeOptions struct {
+	// Strict makes config keys which don't match any struct field an error.
+	Strict bool
+	// Path is the key path of the decoded value, it prefixes key paths in errors.
+	Path string
+}
+
+// Decode decodes the config value into out which should be a pointer, e.g. to a struct.
+// Keys are matched to fields by "uniconf" tags or case insensitive field names, strings are converted
+// to numbers, booleans & durations, missing keys are set from "default" tags.
+func Decode(value interface{}, out interface{}, options DecodeOptions) error {
+	metadata := &mapstructure.Metadata{}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			defaultsHook,
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+		),
+		WeaklyTypedInput: true,
+		Metadata:         metadata,
+		Result:           out,
+		TagName:          DecodeTagName,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("decode error: %v", err)
+	}
+	if options.Strict && len(metadata.Unused) > 0 {
+		keys := make([]string, len(metadata.Unused))
+		for i, key := range metadata.Unused {
+			keys[i] = JoinPath(options.Path, key)
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// defaultsHook adds values of "default" tags to maps decoded into structs if they don't have the keys.
+func defaultsHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	m, ok := data.(map[string]interface{})
+	if !ok || to.Kind() != reflect.Struct {
+		return data, nil
+	}
+	var result map[string]interface{}
+	for i := 0; i < to.NumField(); i++ {
+		field := to.Field(i)
+		var value interface{}
+		if v, ok := field.Tag.Lookup(DefaultTagName); ok {
+			value = v
+		} else if hasDefaults(field.Type) {
+			// Empty maps make nested structs decoded to set their defaults.
+			value = make(map[string]interface{})
+		} else {
+			continue
+		}
+		key := strings.Split(field.Tag.Get(DecodeTagName), ",")[0]
+		if key == "" {
+			key = field.Name
+		}
+		if hasKeyFold(m, key) {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]interface{}, len(m)+1)
+			for k, v := range m {
+				result[k] = v
+			}
+		}
+		result[key] = value
+	}
+	if result == nil {
+		return data, nil
+	}
+	return result, nil
+}
+
+// hasDefaults returns true if the struct type or its nested structs have "default" tags.
+func hasDefaults(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if _, ok := field.Tag.Lookup(DefaultTagName); ok || hasDefaults(field.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKeyFold(m map[string]interface{}, key string) bool {
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
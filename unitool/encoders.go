@@ -0,0 +1,360 @@
+package unitool
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ghodss/yaml"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/pelletier/go-toml"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Key cases of flattened keys.
+const (
+	KeyCasePreserve = "preserve"
+	KeyCaseUpper    = "upper"
+	KeyCaseLower    = "lower"
+)
+
+// EncodeOptions control flattening of nested keys by flat formats, e.g. "a.b" to "A_B" by dotenv.
+// Empty options are set to defaults of the format.
+type EncodeOptions struct {
+	// Separator joins nested keys & list indexes.
+	Separator string
+	// KeyCase is one of "preserve", "upper" or "lower".
+	KeyCase string
+	// Prefix is prepended to flattened keys.
+	Prefix string
+}
+
+// Encoder encodes the config value.
+type Encoder func(value interface{}, options EncodeOptions) ([]byte, error)
+
+var (
+	encoders   = make(map[string]Encoder)
+	encodersMu sync.RWMutex
+)
+
+func init() {
+	RegisterEncoder("yaml", encodeYaml)
+	RegisterEncoder("json", encodeJSON)
+	RegisterEncoder("toml", encodeTOML)
+	RegisterEncoder("hcl", encodeHCL)
+	RegisterEncoder("dotenv", encodeDotenv)
+	RegisterEncoder("shell", encodeShell)
+	RegisterEncoder("properties", encodeProperties)
+}
+
+// RegisterEncoder registers the encoder of the output format, it replaces the registered one.
+func RegisterEncoder(format string, encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[format] = encoder
+}
+
+// Encoders returns names of registered output formats.
+func Encoders() []string {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	formats := make([]string, 0, len(encoders))
+	for format := range encoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Encode encodes the value in the output format.
+func Encode(format string, value interface{}, options EncodeOptions) ([]byte, error) {
+	encoder, err := getEncoder(format, options)
+	if err != nil {
+		return nil, err
+	}
+	return encoder(value, options)
+}
+
+// CheckEncoding returns an error if the output format is not registered or options are invalid.
+func CheckEncoding(format string, options EncodeOptions) error {
+	_, err := getEncoder(format, options)
+	return err
+}
+
+func getEncoder(format string, options EncodeOptions) (Encoder, error) {
+	encodersMu.RLock()
+	encoder, ok := encoders[format]
+	encodersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output format: %s (available: %s)", format, strings.Join(Encoders(), ", "))
+	}
+	switch options.KeyCase {
+	case "", KeyCasePreserve, KeyCaseUpper, KeyCaseLower:
+	default:
+		return nil, fmt.Errorf("unknown key case: %s", options.KeyCase)
+	}
+	return encoder, nil
+}
+
+// KeyValue is the flattened config value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// FlattenKeys returns scalar values of the config value with nested keys joined, sorted by keys.
+// Lists are flattened by indexes, nil values are empty strings, floats aren't in exponent format
+// & timestamps are in RFC 3339 format.
+func FlattenKeys(value interface{}, options EncodeOptions) []KeyValue {
+	result := make([]KeyValue, 0)
+	var flatten func(key string, value interface{})
+	flatten = func(key string, value interface{}) {
+		join := func(k string) string {
+			if key == "" {
+				return k
+			}
+			return key + options.Separator + k
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				flatten(join(k), item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				flatten(join(strconv.Itoa(i)), item)
+			}
+		case nil:
+			result = append(result, KeyValue{key, ""})
+		case float64:
+			result = append(result, KeyValue{key, strconv.FormatFloat(v, 'f', -1, 64)})
+		case float32:
+			result = append(result, KeyValue{key, strconv.FormatFloat(float64(v), 'f', -1, 32)})
+		case time.Time:
+			result = append(result, KeyValue{key, v.Format(time.RFC3339)})
+		default:
+			result = append(result, KeyValue{key, fmt.Sprint(v)})
+		}
+	}
+	flatten("", value)
+	for i := range result {
+		key := options.Prefix + result[i].Key
+		switch options.KeyCase {
+		case KeyCaseUpper:
+			key = strings.ToUpper(key)
+		case KeyCaseLower:
+			key = strings.ToLower(key)
+		}
+		result[i].Key = key
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// withDefaults returns options with empty fields set to given defaults.
+func (o EncodeOptions) withDefaults(separator, keyCase string) EncodeOptions {
+	if o.Separator == "" {
+		o.Separator = separator
+	}
+	if o.KeyCase == "" {
+		o.KeyCase = keyCase
+	}
+	return o
+}
+
+func encodeYaml(value interface{}, options EncodeOptions) ([]byte, error) {
+	stream, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), stream...), nil
+}
+
+func encodeJSON(value interface{}, options EncodeOptions) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func encodeTOML(value interface{}, options EncodeOptions) (stream []byte, err error) {
+	m, ok := withoutNils(value).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("toml: only maps can be encoded, got %T", value)
+	}
+	// TOML trees can't hold lists of mixed types and go-toml panics on them.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("toml: %v", r)
+		}
+	}()
+	tree, err := toml.TreeFromMap(m)
+	if err != nil {
+		return nil, fmt.Errorf("toml: %v", err)
+	}
+	s, err := tree.ToTomlString()
+	return []byte(s), err
+}
+
+// withoutNils returns the value without nil map values as TOML doesn't support them.
+func withoutNils(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			if item != nil {
+				m[k] = withoutNils(item)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = withoutNils(item)
+		}
+		return l
+	}
+	return value
+}
+
+// encodeHCL encodes the map as HCL attributes, e.g. Terraform variables file.
+func encodeHCL(value interface{}, options EncodeOptions) ([]byte, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("hcl: only maps can be encoded, got %T", value)
+	}
+	file := hclwrite.NewEmptyFile()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !hclsyntax.ValidIdentifier(k) {
+			return nil, fmt.Errorf("hcl: key %q is not a valid identifier", k)
+		}
+		stream, err := json.Marshal(m[k])
+		if err != nil {
+			return nil, fmt.Errorf("hcl: %s: %v", k, err)
+		}
+		t, err := ctyjson.ImpliedType(stream)
+		if err != nil {
+			return nil, fmt.Errorf("hcl: %s: %v", k, err)
+		}
+		v, err := ctyjson.Unmarshal(stream, t)
+		if err != nil {
+			return nil, fmt.Errorf("hcl: %s: %v", k, err)
+		}
+		file.Body().SetAttributeValue(k, v)
+	}
+	return file.Bytes(), nil
+}
+
+var (
+	envKeyRe       = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	dotenvPlainRe  = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,-]*$`)
+	dotenvReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+)
+
+// envKeyValues returns flattened values with keys made valid variable names: characters other than letters, digits
+// & underscores are replaced with underscores, keys starting with digits are prefixed with underscores.
+// Different keys made the same name are errors, e.g. "a.b" & "a-b".
+func envKeyValues(value interface{}, options EncodeOptions) ([]KeyValue, error) {
+	keyValues := FlattenKeys(value, options.withDefaults("_", KeyCaseUpper))
+	keys := make(map[string]string, len(keyValues))
+	for i, kv := range keyValues {
+		key := envKeyRe.ReplaceAllString(kv.Key, "_")
+		if key != "" && unicode.IsDigit(rune(key[0])) {
+			key = "_" + key
+		}
+		if k, ok := keys[key]; ok {
+			return nil, fmt.Errorf("keys %s and %s are both encoded as %s", k, kv.Key, key)
+		}
+		keys[key] = kv.Key
+		keyValues[i].Key = key
+	}
+	return keyValues, nil
+}
+
+// encodeDotenv encodes flattened values as "KEY=value" lines, values with special characters are double quoted.
+func encodeDotenv(value interface{}, options EncodeOptions) ([]byte, error) {
+	keyValues, err := envKeyValues(value, options)
+	if err != nil {
+		return nil, fmt.Errorf("dotenv: %v", err)
+	}
+	var b strings.Builder
+	for _, kv := range keyValues {
+		v := kv.Value
+		if !dotenvPlainRe.MatchString(v) {
+			v = `"` + dotenvReplacer.Replace(v) + `"`
+		}
+		fmt.Fprintf(&b, "%s=%s\n", kv.Key, v)
+	}
+	return []byte(b.String()), nil
+}
+
+// encodeShell encodes flattened values as "export KEY='value'" lines.
+func encodeShell(value interface{}, options EncodeOptions) ([]byte, error) {
+	keyValues, err := envKeyValues(value, options)
+	if err != nil {
+		return nil, fmt.Errorf("shell: %v", err)
+	}
+	var b strings.Builder
+	for _, kv := range keyValues {
+		fmt.Fprintf(&b, "export %s='%s'\n", kv.Key, strings.Replace(kv.Value, "'", `'\''`, -1))
+	}
+	return []byte(b.String()), nil
+}
+
+// encodeProperties encodes flattened values as Java properties, e.g. "a.b=value".
+func encodeProperties(value interface{}, options EncodeOptions) ([]byte, error) {
+	var b strings.Builder
+	for _, kv := range FlattenKeys(value, options.withDefaults(".", KeyCasePreserve)) {
+		fmt.Fprintf(&b, "%s=%s\n", escapeProperty(kv.Key, true), escapeProperty(kv.Value, false))
+	}
+	return []byte(b.String()), nil
+}
+
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case strings.ContainsRune("=:#!", r) && (key || i == 0):
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			if r > 0xffff {
+				for _, c := range utf16Units(r) {
+					fmt.Fprintf(&b, `\u%04x`, c)
+				}
+			} else {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// utf16Units returns the surrogate pair of the rune outside of the basic plane.
+func utf16Units(r rune) []rune {
+	r -= 0x10000
+	return []rune{0xd800 + (r>>10)&0x3ff, 0xdc00 + r&0x3ff}
+}
@@ -0,0 +1,156 @@
+package unitool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	hcl1 "github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/pelletier/go-toml"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"gopkg.in/ini.v1"
+)
+
+// UnmarshalTOML decodes the TOML document, dates are converted to RFC 3339 strings.
+func UnmarshalTOML(stream []byte) (map[string]interface{}, error) {
+	tree, err := toml.LoadBytes(stream)
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalTOML error: %v", err)
+	}
+	return normalize(tree.ToMap())
+}
+
+// UnmarshalHCL decodes the HCL2 attributes file, e.g. Terraform variables file,
+// HCL1 is used for files having blocks, single blocks are decoded as maps and repeated ones as lists.
+func UnmarshalHCL(stream []byte) (map[string]interface{}, error) {
+	if m, ok := unmarshalHCL2Attributes(stream); ok {
+		return m, nil
+	}
+	var m map[string]interface{}
+	if err := hcl1.Unmarshal(stream, &m); err != nil {
+		return nil, fmt.Errorf("UnmarshalHCL error: %v", err)
+	}
+	return normalize(unwrapHCL1Blocks(m))
+}
+
+func unmarshalHCL2Attributes(stream []byte) (map[string]interface{}, bool) {
+	file, diags := hclsyntax.ParseConfig(stream, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, false
+	}
+	attributes, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, false
+	}
+	m := make(map[string]interface{}, len(attributes))
+	for name, attribute := range attributes {
+		value, diags := attribute.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, false
+		}
+		stream, err := ctyjson.SimpleJSONValue{Value: value}.MarshalJSON()
+		if err != nil {
+			return nil, false
+		}
+		v, err := decodeJSONNumbers(stream)
+		if err != nil {
+			return nil, false
+		}
+		m[name] = v
+	}
+	return m, true
+}
+
+// unwrapHCL1Blocks converts lists of objects produced by HCL1 for blocks to maps if they have single elements.
+func unwrapHCL1Blocks(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = unwrapHCL1Blocks(item)
+		}
+	case []map[string]interface{}:
+		if len(v) == 1 {
+			return unwrapHCL1Blocks(v[0])
+		}
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = unwrapHCL1Blocks(item)
+		}
+		return list
+	case []interface{}:
+		for i, item := range v {
+			v[i] = unwrapHCL1Blocks(item)
+		}
+	}
+	return value
+}
+
+// UnmarshalINI decodes the INI document, keys of the default section are top level keys,
+// other sections are maps, all values are strings.
+func UnmarshalINI(stream []byte) (map[string]interface{}, error) {
+	file, err := ini.Load(stream)
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalINI error: %v", err)
+	}
+	m := make(map[string]interface{})
+	for _, section := range file.Sections() {
+		keys := m
+		if section.Name() != ini.DefaultSection {
+			keys = make(map[string]interface{})
+			m[section.Name()] = keys
+		}
+		for _, key := range section.Keys() {
+			keys[key.Name()] = key.Value()
+		}
+	}
+	return m, nil
+}
+
+// normalize converts decoded values to types produced by YAML decoding, e.g. int & float64 numbers & []interface{} lists,
+// so they can be merged with YAML & JSON configs.
+func normalize(m interface{}) (map[string]interface{}, error) {
+	stream, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeJSONNumbers(stream)
+	if err != nil {
+		return nil, err
+	}
+	result, _ := v.(map[string]interface{})
+	return result, nil
+}
+
+// decodeJSONNumbers decodes the JSON value, integers are decoded as int & other numbers as float64.
+func decodeJSONNumbers(stream []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(stream))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return jsonNumbers(v), nil
+}
+
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 0); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,484 @@
+package unitool
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// List merge strategies.
+const (
+	// ListAppend appends source items to destination ones (default).
+	ListAppend = "append"
+	// ListPrepend puts source items before destination ones.
+	ListPrepend = "prepend"
+	// ListReplace replaces destination items with source ones.
+	ListReplace = "replace"
+	// ListUnique appends source items which are not in the destination list yet.
+	ListUnique = "unique"
+	// ListMergeByKey deeply merges map items having the same key field value, e.g. "name",
+	// other items are appended unless they are in the destination list already.
+	ListMergeByKey = "merge-by-key"
+)
+
+// Inline list merge directive keys, e.g. "tags: {_merge: unique, items: [a, b]}".
+const (
+	MergeDirectiveKey      = "_merge"
+	MergeDirectiveFieldKey = "_key"
+	MergeDirectiveItemsKey = "items"
+)
+
+// Directives removing values set by lower layers, they are kept in merged configs
+// to be honored by following merges and are removed by StripDirectives:
+// "key: !delete" removes the key, "- !delete a" removes "a" list items,
+// "_replace: true" replaces the whole map instead of deep merging & "_unset: [a, b]" removes map keys.
+const (
+	DeleteDirective     = "!delete"
+	ReplaceDirectiveKey = "_replace"
+	UnsetDirectiveKey   = "_unset"
+)
+
+const defaultListMergeKey = "name"
+
+// ListStrategy defines how lists are merged.
+type ListStrategy struct {
+	Strategy string
+	// Key is the item field used by the merge-by-key strategy, "name" is used if it is empty.
+	Key string
+}
+
+// ParseListStrategy parses the strategy like "unique" or "merge-by-key:id".
+func ParseListStrategy(s string) (ListStrategy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	strategy := ListStrategy{Strategy: parts[0]}
+	if len(parts) > 1 {
+		strategy.Key = parts[1]
+	}
+	switch strategy.Strategy {
+	case ListAppend, ListPrepend, ListReplace, ListUnique, ListMergeByKey:
+		return strategy, nil
+	}
+	return strategy, fmt.Errorf("unknown list merge strategy: %s", strategy.Strategy)
+}
+
+// MergeOptions control merging of config values.
+type MergeOptions struct {
+	// Override replaces existing scalar values.
+	Override bool
+	// Lists is the default list merge strategy, lists are appended if it is empty.
+	Lists ListStrategy
+	// Paths set list merge strategies by dotted key paths, "*" matches any key, e.g. "jobs.*.tags".
+	Paths map[string]ListStrategy
+}
+
+// Merge merges src into dst, lists are appended unless inline directives set other strategies.
+func Merge(dst, src interface{}, overrideDstStringValues bool) interface{} {
+	return MergeWithOptions(dst, src, MergeOptions{Override: overrideDstStringValues})
+}
+
+// MergeWithOptions merges src into dst using list merge strategies from options.
+func MergeWithOptions(dst, src interface{}, options MergeOptions) interface{} {
+	return MergeWithOrigins(dst, src, options, nil, nil)
+}
+
+// MergeWithOrigins merges src into dst like MergeWithOptions and records origins of merged values from srcOrigins in dstOrigins.
+func MergeWithOrigins(dst, src interface{}, options MergeOptions, dstOrigins, srcOrigins Origins) interface{} {
+	if src == nil {
+		return dst
+	}
+	if srcMap, ok := src.(map[string]interface{}); ok {
+		if dst == nil {
+			dst = make(map[string]interface{})
+		}
+		m := &merger{options: options, dstOrigins: dstOrigins, srcOrigins: srcOrigins}
+		m.mergeMap(dst.(map[string]interface{}), srcMap, "", "")
+	}
+	return dst
+}
+
+type merger struct {
+	options    MergeOptions
+	dstOrigins Origins
+	srcOrigins Origins
+}
+
+// mergeMap merges src into dst, directives of src are honored if values are overridden, otherwise ones of dst.
+func (m *merger) mergeMap(dst, src map[string]interface{}, dstPath, srcPath string) {
+	var unset []string
+	if m.options.Override {
+		for _, k := range unsetKeys(src) {
+			if _, ok := dst[k]; ok {
+				delete(dst, k)
+				if m.dstOrigins != nil {
+					m.dstOrigins.DeleteTree(JoinPath(dstPath, k))
+				}
+			}
+		}
+	} else {
+		unset = unsetKeys(dst)
+	}
+	for k, v := range src {
+		dp, sp := JoinPath(dstPath, k), JoinPath(srcPath, k)
+		d, ok := dst[k]
+		if !ok { // No key in dst.
+			if !StringListContains(unset, k) {
+				dst[k] = m.insert(v, dp, sp)
+			}
+			continue
+		}
+		if !m.options.Override && d == DeleteDirective {
+			continue
+		}
+		if items, strategy, ok := listDirective(v); ok {
+			if d, ok := d.([]interface{}); ok {
+				dst[k] = m.mergeList(d, items, dp, JoinPath(sp, MergeDirectiveItemsKey), strategy)
+				continue
+			}
+			m.replace(dst, k, v, dp, sp)
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if d, ok := d.(map[string]interface{}); ok {
+				if !m.options.Override && isReplace(d) {
+					continue
+				}
+				if !m.options.Override || !isReplace(v) {
+					m.mergeMap(d, v, dp, sp)
+					continue
+				}
+			}
+		case []interface{}:
+			if d, ok := d.([]interface{}); ok {
+				dst[k] = m.mergeList(d, v, dp, sp, m.listStrategy(dp))
+				continue
+			}
+		case []string:
+			if d, ok := d.([]string); ok {
+				for _, item := range v {
+					if !StringListContains(d, item) {
+						d = append(d, item)
+					}
+				}
+				dst[k] = d
+				continue
+			}
+		default:
+			if !m.options.Override {
+				continue
+			}
+			if !isContainer(d) {
+				dst[k] = v
+				if m.dstOrigins != nil {
+					m.dstOrigins[dp] = append(m.dstOrigins[dp], m.srcOrigins[sp]...)
+				}
+				continue
+			}
+		}
+		m.replace(dst, k, v, dp, sp)
+	}
+}
+
+// replace replaces the dst value of the key with the src one.
+func (m *merger) replace(dst map[string]interface{}, k string, v interface{}, dstPath, srcPath string) {
+	if m.dstOrigins != nil {
+		m.dstOrigins.DeleteTree(dstPath)
+	}
+	dst[k] = m.insert(v, dstPath, srcPath)
+}
+
+// insert returns the src value with inline directives resolved & copies its origins.
+// Values without directives are returned as is.
+func (m *merger) insert(value interface{}, dstPath, srcPath string) interface{} {
+	if items, _, ok := listDirective(value); ok {
+		return m.insert(items, dstPath, JoinPath(srcPath, MergeDirectiveItemsKey))
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var result map[string]interface{}
+		for k, item := range v {
+			resolved := m.insert(item, JoinPath(dstPath, k), JoinPath(srcPath, k))
+			if result == nil && !sameValue(resolved, item) {
+				result = make(map[string]interface{}, len(v))
+				for key, value := range v {
+					result[key] = value
+				}
+			}
+			if result != nil {
+				result[k] = resolved
+			}
+		}
+		if result != nil {
+			return result
+		}
+	case []interface{}:
+		var result []interface{}
+		for i, item := range v {
+			resolved := m.insert(item, JoinPath(dstPath, strconv.Itoa(i)), JoinPath(srcPath, strconv.Itoa(i)))
+			if result == nil && !sameValue(resolved, item) {
+				result = append([]interface{}{}, v...)
+			}
+			if result != nil {
+				result[i] = resolved
+			}
+		}
+		if result != nil {
+			return result
+		}
+	default:
+		if m.dstOrigins != nil {
+			if origins, ok := m.srcOrigins[srcPath]; ok {
+				m.dstOrigins[dstPath] = append([]Origin{}, origins...)
+			}
+		}
+	}
+	return value
+}
+
+// mergedItem is the item of the merged list, dst & src are indexes of items it was made of or -1.
+type mergedItem struct {
+	value    interface{}
+	dst, src int
+}
+
+func (m *merger) mergeList(dst, src []interface{}, dstPath, srcPath string, strategy ListStrategy) []interface{} {
+	items := make([]mergedItem, 0, len(dst)+len(src))
+	dstItems := func() {
+		for i, item := range dst {
+			items = append(items, mergedItem{item, i, -1})
+		}
+	}
+	srcItems := func() {
+		for i, item := range src {
+			items = append(items, mergedItem{item, -1, i})
+		}
+	}
+	switch strategy.Strategy {
+	case "", ListAppend:
+		dstItems()
+		srcItems()
+	case ListPrepend:
+		srcItems()
+		dstItems()
+	case ListReplace:
+		srcItems()
+	case ListUnique:
+		dstItems()
+		for i, item := range src {
+			if !containsItem(items, item) {
+				items = append(items, mergedItem{item, -1, i})
+			}
+		}
+	case ListMergeByKey:
+		key := strategy.Key
+		if key == "" {
+			key = defaultListMergeKey
+		}
+		dstItems()
+	src:
+		for i, item := range src {
+			if item, ok := item.(map[string]interface{}); ok {
+				if id, ok := item[key]; ok {
+					for j := range items {
+						d, ok := items[j].value.(map[string]interface{})
+						if ok && items[j].dst >= 0 && reflect.DeepEqual(d[key], id) {
+							m.mergeMap(d, item, JoinPath(dstPath, strconv.Itoa(items[j].dst)), JoinPath(srcPath, strconv.Itoa(i)))
+							items[j].src = i
+							continue src
+						}
+					}
+				}
+			}
+			if !containsItem(items, item) {
+				items = append(items, mergedItem{item, -1, i})
+			}
+		}
+	default:
+		log.Warnf("Unknown list merge strategy %q of %s, items are appended", strategy.Strategy, dstPath)
+		dstItems()
+		srcItems()
+	}
+
+	// Delete directives of the list having priority remove items of the other one.
+	kept := items[:0]
+	for _, item := range items {
+		if item.src < 0 && m.options.Override && isDeleted(src, item.value) ||
+			item.dst < 0 && !m.options.Override && isDeleted(dst, item.value) {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	items = kept
+
+	var dstOrigins Origins
+	if m.dstOrigins != nil {
+		dstOrigins = m.dstOrigins.Subtree(dstPath)
+		m.dstOrigins.DeleteTree(dstPath)
+	}
+	result := make([]interface{}, len(items))
+	for i, item := range items {
+		path := JoinPath(dstPath, strconv.Itoa(i))
+		if item.dst >= 0 {
+			result[i] = item.value
+			if m.dstOrigins != nil {
+				for p, origins := range dstOrigins.Subtree(strconv.Itoa(item.dst)) {
+					m.dstOrigins[JoinPath(path, p)] = origins
+				}
+			}
+		} else {
+			result[i] = m.insert(item.value, path, JoinPath(srcPath, strconv.Itoa(item.src)))
+		}
+	}
+	return result
+}
+
+func (m *merger) listStrategy(path string) ListStrategy {
+	for pattern, strategy := range m.options.Paths {
+		if matchPath(pattern, path) {
+			return strategy
+		}
+	}
+	return m.options.Lists
+}
+
+// listDirective returns items & the strategy of the inline list merge directive.
+func listDirective(value interface{}) ([]interface{}, ListStrategy, bool) {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ListStrategy{}, false
+	}
+	strategy, ok := v[MergeDirectiveKey].(string)
+	if !ok {
+		return nil, ListStrategy{}, false
+	}
+	items, _ := v[MergeDirectiveItemsKey].([]interface{})
+	key, _ := v[MergeDirectiveFieldKey].(string)
+	return items, ListStrategy{Strategy: strategy, Key: key}, true
+}
+
+// StripDirectives returns the value without delete, replace & unset directives.
+// Values without directives are returned as is.
+func StripDirectives(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var result map[string]interface{}
+		for k, item := range v {
+			stripped := StripDirectives(item)
+			removed := k == ReplaceDirectiveKey || k == UnsetDirectiveKey || item == DeleteDirective
+			if result == nil && (removed || !sameValue(stripped, item)) {
+				result = make(map[string]interface{}, len(v))
+				for key, value := range v {
+					result[key] = value
+				}
+			}
+			if result == nil {
+				continue
+			}
+			if removed {
+				delete(result, k)
+			} else {
+				result[k] = stripped
+			}
+		}
+		if result != nil {
+			return result
+		}
+	case []interface{}:
+		var result []interface{}
+		for i, item := range v {
+			stripped := StripDirectives(item)
+			_, removed := deleteDirective(item)
+			if result == nil && (removed || !sameValue(stripped, item)) {
+				result = append([]interface{}{}, v[:i]...)
+			}
+			if result != nil && !removed {
+				result = append(result, stripped)
+			}
+		}
+		if result != nil {
+			return result
+		}
+	}
+	return value
+}
+
+// deleteDirective returns the value of the list item delete directive, e.g. "a" for "!delete a".
+func deleteDirective(item interface{}) (string, bool) {
+	s, ok := item.(string)
+	if !ok || !strings.HasPrefix(s, DeleteDirective+" ") {
+		return "", false
+	}
+	return strings.TrimPrefix(s, DeleteDirective+" "), true
+}
+
+// isDeleted checks if the list has the delete directive of the item.
+func isDeleted(list []interface{}, item interface{}) bool {
+	if _, ok := deleteDirective(item); ok {
+		return false
+	}
+	for _, i := range list {
+		if value, ok := deleteDirective(i); ok && value == fmt.Sprint(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func isReplace(m map[string]interface{}) bool {
+	replace, _ := m[ReplaceDirectiveKey].(bool)
+	return replace
+}
+
+func unsetKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0)
+	if unset, ok := m[UnsetDirectiveKey].([]interface{}); ok {
+		for _, k := range unset {
+			keys = append(keys, fmt.Sprint(k))
+		}
+	}
+	return keys
+}
+
+// matchPath checks if the dotted path matches the pattern, "*" matches any key.
+func matchPath(pattern, path string) bool {
+	patternKeys, keys := strings.Split(pattern, "."), strings.Split(path, ".")
+	if len(patternKeys) != len(keys) {
+		return false
+	}
+	for i, key := range patternKeys {
+		if key != "*" && key != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsItem(items []mergedItem, value interface{}) bool {
+	for _, item := range items {
+		if reflect.DeepEqual(item.value, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isContainer(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}, []string:
+		return true
+	}
+	return false
+}
+
+// sameValue checks if both values are the same instance, maps & lists are compared by reference.
+func sameValue(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch va.Kind() {
+	case reflect.Map, reflect.Slice:
+		return va.Kind() == vb.Kind() && va.Pointer() == vb.Pointer() && va.Len() == vb.Len()
+	}
+	return true
+}
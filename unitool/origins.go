@@ -0,0 +1,203 @@
+package unitool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// Origin describes where a config value was defined.
+type Origin struct {
+	Source   string `json:"source"`
+	EntityID string `json:"entity_id"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// Position is the line & the column of the value in the config stream.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Origins holds origins of leaf values by their paths, e.g. "jobs.install.level" or "from.0".
+// Each path holds origins of all values defined for it in order of merging, the last one is effective.
+type Origins map[string][]Origin
+
+// JoinPath joins config path elements with dots.
+func JoinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	if key == "" {
+		return path
+	}
+	return path + "." + key
+}
+
+// WalkLeaves calls fn for each leaf value of the config value, e.g. for each scalar & list item.
+func WalkLeaves(value interface{}, path string, fn func(path string, value interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			WalkLeaves(item, JoinPath(path, k), fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			WalkLeaves(item, JoinPath(path, strconv.Itoa(i)), fn)
+		}
+	default:
+		fn(path, value)
+	}
+}
+
+// NewOrigins returns origins of all leaf values of the config defined in the same place,
+// positions of the values are set if they are known.
+func NewOrigins(config map[string]interface{}, origin Origin, positions map[string]Position) Origins {
+	origins := make(Origins)
+	WalkLeaves(config, "", func(path string, value interface{}) {
+		o := origin
+		if position, ok := positions[path]; ok {
+			o.Line, o.Column = position.Line, position.Column
+		}
+		origins[path] = []Origin{o}
+	})
+	return origins
+}
+
+// Subtree returns origins of the value at the path and its nested values keyed by paths relative to it,
+// origins of the value itself are keyed by the empty path.
+func (o Origins) Subtree(path string) Origins {
+	subtree := make(Origins)
+	for p, origins := range o {
+		switch {
+		case path == "":
+			subtree[p] = origins
+		case p == path:
+			subtree[""] = origins
+		case strings.HasPrefix(p, path+"."):
+			subtree[p[len(path)+1:]] = origins
+		}
+	}
+	return subtree
+}
+
+// DeleteTree removes origins of the value at the path and its nested values.
+func (o Origins) DeleteTree(path string) {
+	for p := range o.Subtree(path) {
+		delete(o, JoinPath(path, p))
+	}
+}
+
+// Move moves origins of the value at the path and its nested values to another path.
+func (o Origins) Move(from, to string) {
+	subtree := o.Subtree(from)
+	o.DeleteTree(from)
+	for p, origins := range subtree {
+		o[JoinPath(to, p)] = origins
+	}
+}
+
+// UnmarshalWithPositions decodes the stream like UnmarshalByType & returns positions of its values by their paths,
+// the stream is parsed once for both. Positions are known only for YAML & JSON streams.
+func UnmarshalWithPositions(format string, stream []byte) (map[string]interface{}, map[string]Position, error) {
+	positions := make(map[string]Position)
+	switch format {
+	case "yaml":
+		config, nodes, err := decodeYaml(stream)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UnmarshalYaml error: %v", err)
+		}
+		// Positions of later documents of multi-document streams override preceding ones.
+		for _, node := range nodes {
+			yamlPositions(node, "", positions)
+		}
+		return config, positions, nil
+	case "json":
+		config, err := UnmarshalJSON(stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(stream))
+		jsonPositions(decoder, stream, "", positions)
+		return config, positions, nil
+	}
+	config, err := UnmarshalByType(format, stream)
+	return config, positions, err
+}
+
+func yamlPositions(node *yaml3.Node, path string, positions map[string]Position) {
+	switch node.Kind {
+	case yaml3.DocumentNode:
+		for _, child := range node.Content {
+			yamlPositions(child, path, positions)
+		}
+	case yaml3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			p := JoinPath(path, key.Value)
+			positions[p] = Position{Line: key.Line, Column: key.Column}
+			yamlPositions(value, p, positions)
+		}
+	case yaml3.SequenceNode:
+		for i, item := range node.Content {
+			p := JoinPath(path, strconv.Itoa(i))
+			positions[p] = Position{Line: item.Line, Column: item.Column}
+			yamlPositions(item, p, positions)
+		}
+	case yaml3.AliasNode:
+		if node.Alias != nil {
+			yamlPositions(node.Alias, path, positions)
+		}
+	}
+}
+
+// jsonPositions reads the next JSON value from the decoder & records positions of its nested values.
+func jsonPositions(decoder *json.Decoder, stream []byte, path string, positions map[string]Position) bool {
+	token, err := decoder.Token()
+	if err != nil {
+		return false
+	}
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			position := jsonPosition(stream, decoder.InputOffset())
+			key, err := decoder.Token()
+			if err != nil {
+				return false
+			}
+			p := JoinPath(path, key.(string))
+			positions[p] = position
+			if !jsonPositions(decoder, stream, p, positions) {
+				return false
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			p := JoinPath(path, strconv.Itoa(i))
+			positions[p] = jsonPosition(stream, decoder.InputOffset())
+			if !jsonPositions(decoder, stream, p, positions) {
+				return false
+			}
+		}
+		_, err = decoder.Token()
+	}
+	return err == nil
+}
+
+// jsonPosition returns position of the token following the offset.
+func jsonPosition(stream []byte, offset int64) Position {
+	i := int(offset)
+	for i < len(stream) && strings.ContainsRune(" \t\r\n,:", rune(stream[i])) {
+		i++
+	}
+	line := bytes.Count(stream[:i], []byte("\n")) + 1
+	column := i - bytes.LastIndexByte(stream[:i], '\n')
+	return Position{Line: line, Column: column}
+}
@@ -0,0 +1,50 @@
+package unitool
+
+// ReplaceStrings returns the value with strings replaced by results of fn, maps & lists are copied only if they change.
+func ReplaceStrings(value interface{}, fn func(s string) string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		var result map[string]interface{}
+		for k, item := range v {
+			replaced := ReplaceStrings(item, fn)
+			if result == nil && changed(replaced, item) {
+				result = make(map[string]interface{}, len(v))
+				for k, item := range v {
+					result[k] = item
+				}
+			}
+			if result != nil {
+				result[k] = replaced
+			}
+		}
+		if result == nil {
+			return value
+		}
+		return result
+	case []interface{}:
+		var result []interface{}
+		for i, item := range v {
+			replaced := ReplaceStrings(item, fn)
+			if result == nil && changed(replaced, item) {
+				result = append([]interface{}(nil), v...)
+			}
+			if result != nil {
+				result[i] = replaced
+			}
+		}
+		if result == nil {
+			return value
+		}
+		return result
+	}
+	return value
+}
+
+func changed(replaced, value interface{}) bool {
+	if s, ok := value.(string); ok {
+		return replaced.(string) != s
+	}
+	return !sameValue(replaced, value)
+}
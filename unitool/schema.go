@@ -0,0 +1,89 @@
+package unitool
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SchemaError describes the config value which doesn't match JSON Schema.
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+// ValidateSchema validates the value at the path against JSON Schema, the schema is either a file path,
+// URL or a schema document. Paths of errors are full key paths, e.g. "jobs.install.image".
+func ValidateSchema(value interface{}, path string, schema interface{}) ([]SchemaError, error) {
+	var loader gojsonschema.JSONLoader
+	switch s := schema.(type) {
+	case string:
+		if strings.Contains(s, "://") {
+			loader = gojsonschema.NewReferenceLoader(s)
+		} else {
+			abs, err := filepath.Abs(s)
+			if err != nil {
+				return nil, err
+			}
+			loader = gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs))
+		}
+	case map[string]interface{}:
+		loader = gojsonschema.NewGoLoader(s)
+	default:
+		return nil, fmt.Errorf("schema should be a file path or a schema document, got %T", schema)
+	}
+	result, err := gojsonschema.Validate(loader, gojsonschema.NewGoLoader(value))
+	if err != nil {
+		return nil, fmt.Errorf("schema error: %v", err)
+	}
+	errors := make([]SchemaError, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		field := e.Field()
+		if field == gojsonschema.STRING_CONTEXT_ROOT {
+			field = ""
+		}
+		// Missing required properties are reported for their parents.
+		if property, ok := e.Details()["property"].(string); ok && e.Type() == "required" {
+			field = JoinPath(field, property)
+		}
+		errors = append(errors, SchemaError{Path: JoinPath(path, field), Message: e.Description()})
+	}
+	return errors, nil
+}
+
+// SelectPaths returns values matching the dotted path pattern by their paths,
+// "*" matches any key of maps & index of lists, e.g. "jobs.*".
+func SelectPaths(value interface{}, pattern string) map[string]interface{} {
+	result := make(map[string]interface{})
+	var selectPath func(value interface{}, path string, keys []string)
+	selectPath = func(value interface{}, path string, keys []string) {
+		if len(keys) == 0 {
+			result[path] = value
+			return
+		}
+		key := keys[0]
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				if key == "*" || key == k {
+					selectPath(item, JoinPath(path, k), keys[1:])
+				}
+			}
+		case []interface{}:
+			for i, item := range v {
+				if key == "*" || key == strconv.Itoa(i) {
+					selectPath(item, JoinPath(path, strconv.Itoa(i)), keys[1:])
+				}
+			}
+		}
+	}
+	keys := make([]string, 0)
+	if pattern != "" {
+		keys = strings.Split(pattern, ".")
+	}
+	selectPath(value, "", keys)
+	return result
+}
@@ -0,0 +1,235 @@
+package unitool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// SopsMetadataKey is the key of SOPS metadata in encrypted files.
+const SopsMetadataKey = "sops"
+
+var sopsValueRe = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// DecryptSops decrypts the SOPS encrypted YAML or JSON document using age identities.
+// The data key is decrypted with one of age recipients of the document, the document is verified by its MAC
+// like SOPS does: the MAC is the SHA-512 hash of values in document order. Encrypted comments aren't supported.
+func DecryptSops(stream []byte, identities []age.Identity) (map[string]interface{}, error) {
+	var document yaml3.Node
+	if err := yaml3.NewDecoder(bytes.NewReader(stream)).Decode(&document); err != nil {
+		return nil, fmt.Errorf("DecryptSops error: %v", err)
+	}
+	if document.Kind != yaml3.DocumentNode || len(document.Content) == 0 || document.Content[0].Kind != yaml3.MappingNode {
+		return nil, fmt.Errorf("DecryptSops error: document is not a map")
+	}
+	root := document.Content[0]
+	var metadata map[string]interface{}
+	for i := 0; i < len(root.Content); i += 2 {
+		if root.Content[i].Value == SopsMetadataKey {
+			if err := root.Content[i+1].Decode(&metadata); err != nil {
+				return nil, fmt.Errorf("DecryptSops error: %s metadata: %v", SopsMetadataKey, err)
+			}
+		}
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("DecryptSops error: %s metadata is not found", SopsMetadataKey)
+	}
+	key, err := sopsDataKey(metadata, identities)
+	if err != nil {
+		return nil, fmt.Errorf("DecryptSops error: %v", err)
+	}
+	macOnlyEncrypted, _ := metadata["mac_only_encrypted"].(bool)
+	d := &sopsDecrypter{key: key, hash: sha512.New(), macOnlyEncrypted: macOnlyEncrypted}
+	result := make(map[string]interface{})
+	for i := 0; i < len(root.Content); i += 2 {
+		k := root.Content[i].Value
+		if k == SopsMetadataKey {
+			continue
+		}
+		if result[k], err = d.decrypt(root.Content[i+1], k+":"); err != nil {
+			return nil, fmt.Errorf("DecryptSops error: %v", err)
+		}
+	}
+	if err := d.verify(metadata); err != nil {
+		return nil, fmt.Errorf("DecryptSops error: %v", err)
+	}
+	return result, nil
+}
+
+// sopsDataKey decrypts the data key of the document with the first matching age recipient.
+func sopsDataKey(metadata map[string]interface{}, identities []age.Identity) ([]byte, error) {
+	recipients, _ := metadata["age"].([]interface{})
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("age recipients are not found")
+	}
+	var lastErr error
+	for _, recipient := range recipients {
+		r, _ := recipient.(map[string]interface{})
+		enc, _ := r["enc"].(string)
+		reader, err := age.Decrypt(armor.NewReader(strings.NewReader(enc)), identities...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("data key is not decrypted: %v", lastErr)
+}
+
+// sopsDecrypter decrypts values of the document with the data key & hashes them for the MAC.
+type sopsDecrypter struct {
+	key              []byte
+	hash             hash.Hash
+	macOnlyEncrypted bool
+}
+
+// decrypt decrypts values of the node, the additional data of values are paths of their map keys, e.g. "db:password:".
+func (d *sopsDecrypter) decrypt(node *yaml3.Node, path string) (interface{}, error) {
+	switch node.Kind {
+	case yaml3.MappingNode:
+		m := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i < len(node.Content); i += 2 {
+			k := node.Content[i].Value
+			decrypted, err := d.decrypt(node.Content[i+1], path+k+":")
+			if err != nil {
+				return nil, err
+			}
+			m[k] = decrypted
+		}
+		return m, nil
+	case yaml3.SequenceNode:
+		l := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			decrypted, err := d.decrypt(item, path)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = decrypted
+		}
+		return l, nil
+	case yaml3.AliasNode:
+		return d.decrypt(node.Alias, path)
+	}
+	if node.ShortTag() == "!!str" && sopsValueRe.MatchString(node.Value) {
+		value, err := decryptSopsValue(node.Value, path, d.key)
+		if err != nil {
+			return nil, err
+		}
+		return value, d.write(value, path)
+	}
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return nil, fmt.Errorf("%s: %v", sopsPath(path), err)
+	}
+	if d.macOnlyEncrypted {
+		return value, nil
+	}
+	return value, d.write(value, path)
+}
+
+// write writes the value to the hash the way SOPS converts values to bytes.
+func (d *sopsDecrypter) write(value interface{}, path string) error {
+	var b []byte
+	switch v := value.(type) {
+	case string:
+		b = []byte(v)
+	case int:
+		b = []byte(strconv.Itoa(v))
+	case float64:
+		b = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		b = []byte("False")
+		if v {
+			b = []byte("True")
+		}
+	case nil:
+	default:
+		return fmt.Errorf("%s: unsupported value type %T", sopsPath(path), value)
+	}
+	d.hash.Write(b)
+	return nil
+}
+
+// verify compares the hash of values with the MAC of the document, it is encrypted with its last modification time
+// as the additional data.
+func (d *sopsDecrypter) verify(metadata map[string]interface{}) error {
+	mac, _ := metadata["mac"].(string)
+	if mac == "" {
+		return fmt.Errorf("MAC is not found")
+	}
+	var lastModified string
+	switch v := metadata["lastmodified"].(type) {
+	case string:
+		lastModified = v
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			lastModified = t.Format(time.RFC3339)
+		}
+	case time.Time:
+		lastModified = v.Format(time.RFC3339)
+	default:
+		return fmt.Errorf("lastmodified is not found")
+	}
+	expected, err := decryptSopsValue(mac, lastModified, d.key)
+	if err != nil {
+		return fmt.Errorf("MAC is not decrypted: %v", err)
+	}
+	if fmt.Sprint(expected) != fmt.Sprintf("%X", d.hash.Sum(nil)) {
+		return fmt.Errorf("MAC mismatch, the document was modified")
+	}
+	return nil
+}
+
+func decryptSopsValue(value, path string, key []byte) (interface{}, error) {
+	match := sopsValueRe.FindStringSubmatch(value)
+	if match == nil {
+		return nil, fmt.Errorf("invalid encrypted value")
+	}
+	parts := make([][]byte, 3)
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(match[i+1]); err != nil {
+			return nil, fmt.Errorf("%s: invalid encrypted value: %v", sopsPath(path), err)
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sopsPath(path), err)
+	}
+	s := string(plaintext)
+	switch match[4] {
+	case "int":
+		return strconv.Atoi(s)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	}
+	return s, nil
+}
+
+// sopsPath converts the additional data path to the dotted key path.
+func sopsPath(path string) string {
+	return strings.Replace(strings.TrimSuffix(path, ":"), ":", ".", -1)
+}
@@ -18,17 +18,20 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/ghodss/yaml"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 )
 
 func init() {
@@ -36,84 +39,27 @@ func init() {
 	gob.Register(map[string]string{})
 	gob.Register(map[string][]string{})
 	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
 }
 
-// TODO: Add merge for lists (initial arguments).
-func Merge(dst, src interface{}, overrideDstStringValues bool) interface{} {
-	return merge(dst, src, "", overrideDstStringValues)
-}
-func merge(dst, src interface{}, id string, overrideDstStringValues bool) interface{} {
-	if src == nil {
-		return dst
-	}
-	switch src.(type) {
-	case map[string]interface{}:
-		for k, v := range src.(map[string]interface{}) {
-			if dst == nil {
-				dst = make(map[string]interface{})
-			}
-			if _, ok := dst.(map[string]interface{})[k]; !ok { // No key in dst.
-				dst.(map[string]interface{})[k] = v
-			} else {
-				switch v.(type) {
-				case map[string]interface{}:
-					switch dst.(map[string]interface{})[k].(type) {
-					case map[string]interface{}:
-						dst.(map[string]interface{})[k] = merge(dst.(map[string]interface{})[k].(map[string]interface{}), v.(map[string]interface{}), id+"_"+k, overrideDstStringValues)
-					default:
-						dst.(map[string]interface{})[k] = v
-					}
-				case []interface{}:
-					switch dst.(map[string]interface{})[k].(type) {
-					case []interface{}:
-						for _, item := range v.([]interface{}) {
-							dst.(map[string]interface{})[k] = append(dst.(map[string]interface{})[k].([]interface{}), item)
-						}
-					default:
-						dst.(map[string]interface{})[k] = v
-					}
-				case []string:
-					switch dst.(map[string]interface{})[k].(type) {
-					case []string:
-						for _, item := range v.([]string) {
-							if !StringListContains(dst.(map[string]interface{})[k].([]string), item) {
-								dst.(map[string]interface{})[k] = append(dst.(map[string]interface{})[k].([]string), item)
-							}
-						}
-					default:
-						dst.(map[string]interface{})[k] = v
-					}
-				default:
-					if overrideDstStringValues {
-						dst.(map[string]interface{})[k] = v
-					}
-				}
-			}
-		}
-	}
-	return dst
-}
-
-func ReadFile(filename string) []byte {
+func ReadFile(filename string) ([]byte, error) {
 	log.Debugf("Read file: %s", filename)
 	f, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Panicf("ReadFile error: %v ", err)
+		return nil, fmt.Errorf("ReadFile error: %v", err)
 	}
-	return f
+	return f, nil
 }
 
 func GitClone(url, referenceName, path string, depth int, singleBranch bool) error {
 	log.Printf("Clone repo: %s", url)
-	oldStdout, oldStderr := disableStdStreams(true, false)
 	_, err := git.PlainClone(path, false, &git.CloneOptions{
 		URL:           url,
-		Progress:      os.Stdout,
+		Progress:      ioutil.Discard,
 		SingleBranch:  singleBranch,
 		Depth:         depth,
 		ReferenceName: plumbing.ReferenceName(referenceName),
 	})
-	enableStdStreams(oldStdout, oldStderr)
 	if err != nil {
 		log.Printf("Error: %s", err)
 		return err
@@ -122,54 +68,120 @@ func GitClone(url, referenceName, path string, depth int, singleBranch bool) err
 	return nil
 }
 
-func disableStdStreams(disableStdout, disableStderr bool) (oldStdout, oldStderr *os.File) {
-	if disableStdout {
-		oldStdout = os.Stdout
-		stdoutFile := filepath.Join(os.TempDir(), "unitools_stdout")
-		temp, _ := os.Create(stdoutFile)
-		os.Stdout = temp
+// GitOptions describes the repository checkout.
+type GitOptions struct {
+	URL string
+	// ReferenceName is the full name of the branch or tag to clone, e.g. "refs/heads/master".
+	ReferenceName string
+	// Commit pins the checkout to the commit, the whole history is fetched in this case.
+	Commit string
+	// Subpath limits the checkout to files of the subdirectory, they are placed in the Path root.
+	Subpath string
+	Path    string
+	Auth    transport.AuthMethod
+}
+
+// GitCheckout clones the repository & checks out its files, it returns hash of the checked out commit.
+func GitCheckout(o GitOptions) (string, error) {
+	log.Printf("Clone repo: %s", o.URL)
+	depth := 1
+	if o.Commit != "" {
+		depth = 0
 	}
-	if disableStderr {
-		oldStderr = os.Stderr
-		stderrFile := filepath.Join(os.TempDir(), "unitools_stderr")
-		temp2, _ := os.Create(stderrFile)
-		os.Stderr = temp2
+	// Progress is discarded, global streams must not be touched as sources are cloned concurrently.
+	repo, err := git.PlainClone(o.Path, false, &git.CloneOptions{
+		URL:           o.URL,
+		Auth:          o.Auth,
+		Progress:      ioutil.Discard,
+		SingleBranch:  o.ReferenceName != "",
+		Depth:         depth,
+		ReferenceName: plumbing.ReferenceName(o.ReferenceName),
+		NoCheckout:    true,
+	})
+	if err != nil {
+		return "", err
 	}
-	return
-}
 
-func enableStdStreams(oldStdout, oldStderr *os.File) {
-	// Restore all stdout & stderr output.
-	os.Stdout = oldStdout
-	os.Stderr = oldStderr
-}
+	var hash plumbing.Hash
+	if o.Commit != "" {
+		h, err := repo.ResolveRevision(plumbing.Revision(o.Commit))
+		if err != nil {
+			return "", fmt.Errorf("resolve commit %s: %v", o.Commit, err)
+		}
+		hash = *h
+	} else {
+		head, err := repo.Head()
+		if err != nil {
+			return "", err
+		}
+		hash = head.Hash()
+		// Annotated tags point to the tag object.
+		if tag, err := repo.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return "", err
+	}
 
-func UnmarshalByType(t string, stream []byte) (map[string]interface{}, error) {
-	if t == "yaml" {
-		return UnmarshalYaml(stream)
+	if o.Subpath == "" {
+		worktree, err := repo.Worktree()
+		if err != nil {
+			return "", err
+		}
+		if err := worktree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true}); err != nil {
+			return "", err
+		}
+		return hash.String(), nil
 	}
-	if t == "json" {
-		return UnmarshalJSON(stream)
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
 	}
-	return nil, errors.New("unknown type")
+	subtree, err := tree.Tree(strings.Trim(o.Subpath, "/"))
+	if err != nil {
+		return "", fmt.Errorf("subpath %s: %v", o.Subpath, err)
+	}
+	err = subtree.Files().ForEach(func(f *object.File) error {
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(o.Path, f.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(file, []byte(contents), 0644)
+	})
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
 }
 
-func UnmarshalYaml(stream []byte) (map[string]interface{}, error) {
-	y := make(map[string]interface{})
-	err := yaml.Unmarshal(stream, &y)
-	if err != nil {
-		log.Fatalf("UnmarshalYaml error: %v", err)
-		return nil, err
+func UnmarshalByType(t string, stream []byte) (map[string]interface{}, error) {
+	switch t {
+	case "yaml":
+		return UnmarshalYaml(stream)
+	case "json":
+		return UnmarshalJSON(stream)
+	case "toml":
+		return UnmarshalTOML(stream)
+	case "hcl":
+		return UnmarshalHCL(stream)
+	case "ini":
+		return UnmarshalINI(stream)
 	}
-	return y, nil
+	return nil, fmt.Errorf("unknown type: %s", t)
 }
 
 func UnmarshalJSON(stream []byte) (map[string]interface{}, error) {
 	y := make(map[string]interface{})
 	err := json.Unmarshal(stream, &y)
 	if err != nil {
-		log.Panicf("UnmarshalYaml error: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("UnmarshalJSON error: %v", err)
 	}
 	return y, nil
 }
@@ -246,13 +258,21 @@ func SearchMapWithPathPrefixes(source map[string]interface{}, path []string) int
 }
 
 func DeepCollectParams(source map[string]interface{}, path, key string) (map[string]interface{}, error) {
+	params, _, err := DeepCollectParamsWithOrigins(source, path, key, nil)
+	return params, err
+}
+
+// DeepCollectParamsWithOrigins collects params like DeepCollectParams & returns origins of collected values
+// keyed by their paths in params, origins are ones of source values.
+func DeepCollectParamsWithOrigins(source map[string]interface{}, path, key string, origins Origins) (map[string]interface{}, Origins, error) {
 	source, err := DeepCopyMap(source)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	path = strings.Trim(path, ".")
 	pathParts := strings.Split(path, ".")
 	params := make(map[string]interface{})
+	paramsOrigins := make(Origins)
 	p := ""
 	for i := 0; i < len(pathParts); i++ {
 		if p != "" {
@@ -262,23 +282,31 @@ func DeepCollectParams(source map[string]interface{}, path, key string) (map[str
 		}
 		result := SearchMapWithPathStringPrefixes(source, p+"."+key)
 		if result != nil {
-			params = Merge(params, result, true).(map[string]interface{})
+			params = MergeWithOrigins(params, result, MergeOptions{Override: true}, paramsOrigins, origins.Subtree(p+"."+key)).(map[string]interface{})
 		}
 	}
 	params, err = DeepCopyMap(params)
-	return params, err
+	return params, paramsOrigins, err
 }
 
 // DeepCollectChildren collects params from nesting structures
 // For example: jobs.dev.jobs.install - to collect params from this structure pass path=dev.install and key=jobs.
 func DeepCollectChildren(source map[string]interface{}, path, key string) (map[string]interface{}, error) {
+	params, _, err := DeepCollectChildrenWithOrigins(source, path, key, nil)
+	return params, err
+}
+
+// DeepCollectChildrenWithOrigins collects params like DeepCollectChildren & returns origins of collected values
+// keyed by their paths in params, origins are ones of source values.
+func DeepCollectChildrenWithOrigins(source map[string]interface{}, path, key string, origins Origins) (map[string]interface{}, Origins, error) {
 	source, err := DeepCopyMap(source)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	path = strings.Trim(path, ".")
 	pathParts := strings.Split(path, ".")
 	params := make(map[string]interface{})
+	paramsOrigins := make(Origins)
 	p := ""
 	for i := 0; i < len(pathParts); i++ {
 		if p != "" {
@@ -290,10 +318,10 @@ func DeepCollectChildren(source map[string]interface{}, path, key string) (map[s
 		if result != nil {
 			result, _ := DeepCopyMap(result.(map[string]interface{}))
 			delete(result, key)
-			params = Merge(params, result, true).(map[string]interface{})
+			params = MergeWithOrigins(params, result, MergeOptions{Override: true}, paramsOrigins, origins.Subtree(p)).(map[string]interface{})
 		}
 	}
-	return params, nil
+	return params, paramsOrigins, nil
 }
 
 // DeepCopyMap performs a deep copy of the given map m.
@@ -313,6 +341,25 @@ func DeepCopyMap(m map[string]interface{}) (map[string]interface{}, error) {
 	return copy, nil
 }
 
+// CopyValue returns the deep copy of maps & lists of the value, other values are shared.
+func CopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = CopyValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = CopyValue(item)
+		}
+		return result
+	}
+	return value
+}
+
 func StringListContains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -344,6 +391,12 @@ func FormatByExtension(f string) string {
 		return "yaml"
 	case ".json":
 		return "json"
+	case ".toml":
+		return "toml"
+	case ".hcl", ".tfvars":
+		return "hcl"
+	case ".ini":
+		return "ini"
 	}
 	return ""
 }
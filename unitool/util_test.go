@@ -1,7 +1,26 @@
 package unitool
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/ghodss/yaml"
 )
 
 func TestMerge(t *testing.T) {
@@ -112,6 +131,581 @@ func TestCollectKeyParamsFromJsonPath(t *testing.T) {
 	}
 }
 
+func TestMergeWithOrigins(t *testing.T) {
+	stream := []byte(`{
+  "key1": {"key1_subkey1": "a"},
+  "list": ["a"]
+}`)
+	dst, positions, err := UnmarshalWithPositions("json", stream)
+	if err != nil {
+		t.Fatalf("UnmarshalWithPositions err: %v", err)
+	}
+	if positions["key1.key1_subkey1"] != (Position{Line: 2, Column: 12}) {
+		t.Errorf("JSON position is wrong: %v", positions["key1.key1_subkey1"])
+	}
+	if positions["list.0"] != (Position{Line: 3, Column: 12}) {
+		t.Errorf("JSON position is wrong: %v", positions["list.0"])
+	}
+
+	dstOrigins := NewOrigins(dst, Origin{Source: "dst"}, positions)
+	src := map[string]interface{}{
+		"key1": map[string]interface{}{"key1_subkey1": "b"},
+		"list": []interface{}{"b"},
+	}
+	srcOrigins := NewOrigins(src, Origin{Source: "src"}, nil)
+	MergeWithOrigins(dst, src, MergeOptions{Override: true}, dstOrigins, srcOrigins)
+
+	if origins := dstOrigins["key1.key1_subkey1"]; len(origins) != 2 || origins[0].Source != "dst" || origins[1].Source != "src" {
+		t.Errorf("Overridden value origins are wrong: %v", origins)
+	}
+	if origins := dstOrigins["list.1"]; len(origins) != 1 || origins[0].Source != "src" {
+		t.Errorf("Appended item origins are wrong: %v", origins)
+	}
+}
+
+func TestMergeListStrategies(t *testing.T) {
+	merge := func(options MergeOptions, dst, src string) string {
+		d, _ := UnmarshalYaml([]byte(dst))
+		s, _ := UnmarshalYaml([]byte(src))
+		return MarshallJSON(MergeWithOptions(d, s, options))
+	}
+	tests := []struct {
+		options  MergeOptions
+		dst, src string
+		expected string
+	}{
+		{MergeOptions{}, "tags: [a, b]", "tags: [b, c]", `{"tags":["a","b","b","c"]}`},
+		{MergeOptions{Lists: ListStrategy{Strategy: ListPrepend}}, "tags: [a, b]", "tags: [b, c]", `{"tags":["b","c","a","b"]}`},
+		{MergeOptions{Lists: ListStrategy{Strategy: ListReplace}}, "tags: [a, b]", "tags: [b, c]", `{"tags":["b","c"]}`},
+		{MergeOptions{Lists: ListStrategy{Strategy: ListUnique}}, "tags: [a, b]", "tags: [b, c]", `{"tags":["a","b","c"]}`},
+		{MergeOptions{Paths: map[string]ListStrategy{"jobs.*.tags": {Strategy: ListUnique}}}, "jobs: {a: {tags: [a]}}", "jobs: {a: {tags: [a]}}", `{"jobs":{"a":{"tags":["a"]}}}`},
+		{MergeOptions{Lists: ListStrategy{Strategy: ListMergeByKey}},
+			"webhooks: [{name: push, enabled: false, events: [a]}, {name: tag}]",
+			"webhooks: [{name: push, enabled: true, events: [b]}, {name: mr}]",
+			`{"webhooks":[{"enabled":false,"events":["a","b"],"name":"push"},{"name":"tag"},{"name":"mr"}]}`},
+		{MergeOptions{Override: true, Lists: ListStrategy{Strategy: ListMergeByKey, Key: "id"}},
+			"webhooks: [{id: push, enabled: false}]",
+			"webhooks: [{id: push, enabled: true}]",
+			`{"webhooks":[{"enabled":true,"id":"push"}]}`},
+		{MergeOptions{}, "tags: [a, b]", "tags: {_merge: unique, items: [b, c]}", `{"tags":["a","b","c"]}`},
+		{MergeOptions{}, "jobs: {}", "jobs: {a: {tags: {_merge: replace, items: [c]}}}", `{"jobs":{"a":{"tags":["c"]}}}`},
+		{MergeOptions{}, "hooks: [{id: a, v: 1}]", "hooks: {_merge: merge-by-key, _key: id, items: [{id: a, w: 2}]}", `{"hooks":[{"id":"a","v":1,"w":2}]}`},
+	}
+	for _, test := range tests {
+		if result := merge(test.options, test.dst, test.src); result != test.expected {
+			t.Errorf("Merge of %s with %s failed: %s != %s", test.src, test.dst, result, test.expected)
+		}
+	}
+
+	if _, err := ParseListStrategy("merge-by-key:id"); err != nil {
+		t.Errorf("ParseListStrategy err: %v", err)
+	}
+	if _, err := ParseListStrategy("sorted"); err == nil {
+		t.Errorf("ParseListStrategy should fail on unknown strategy")
+	}
+}
+
+func TestMergeDirectives(t *testing.T) {
+	merge := func(override bool, dst, src string) string {
+		d, _ := UnmarshalYaml([]byte(dst))
+		s, err := UnmarshalYaml([]byte(src))
+		if err != nil {
+			t.Errorf("UnmarshalYaml err: %v", err)
+		}
+		return MarshallJSON(StripDirectives(Merge(d, s, override)))
+	}
+	tests := []struct {
+		override bool
+		dst, src string
+		expected string
+	}{
+		{true, "a: 1\nb: 2", "a: !delete", `{"b":2}`},
+		{true, "b: 2", "a: !delete", `{"b":2}`},
+		{true, "m: {a: 1, b: 2}", "m: {_replace: true, c: 3}", `{"m":{"c":3}}`},
+		{true, "m: {a: 1, b: 2, c: 3}", "m: {_unset: [a, b], d: 4}", `{"m":{"c":3,"d":4}}`},
+		{true, "tags: [a, b, c]", "tags: [!delete b, d]", `{"tags":["a","c","d"]}`},
+		// Destination has priority if values are not overridden.
+		{false, "a: !delete\nb: 2", "a: 1\nc: 3", `{"b":2,"c":3}`},
+		{false, "m: {_replace: true, c: 3}", "m: {a: 1}", `{"m":{"c":3}}`},
+		{false, "m: {_unset: [a], c: 3}", "m: {a: 1, b: 2}", `{"m":{"b":2,"c":3}}`},
+		{false, "tags: [!delete b, d]", "tags: [a, b]", `{"tags":["d","a"]}`},
+	}
+	for _, test := range tests {
+		if result := merge(test.override, test.dst, test.src); result != test.expected {
+			t.Errorf("Merge of %q with %q failed: %s != %s", test.src, test.dst, result, test.expected)
+		}
+	}
+
+	config, _ := UnmarshalJSON([]byte(`{"a": "!delete", "b": {"_unset": ["c"]}}`))
+	if result := MarshallJSON(StripDirectives(config)); result != `{"b":{}}` {
+		t.Errorf("StripDirectives failed: %s", result)
+	}
+}
+
+func TestUnmarshalFormats(t *testing.T) {
+	tests := []struct {
+		format, stream, expected string
+	}{
+		{"toml", "a = 1\n[b]\nc = [\"d\"]\n", `{"a":1,"b":{"c":["d"]}}`},
+		{"hcl", "a = 1\nb = { c = [\"d\"] }\n", `{"a":1,"b":{"c":["d"]}}`},
+		{"hcl", "service \"web\" {\n  port = 80\n}\n", `{"service":{"web":{"port":80}}}`},
+		{"ini", "a = 1\n[b]\nc = d\n", `{"a":"1","b":{"c":"d"}}`},
+	}
+	for _, test := range tests {
+		m, err := UnmarshalByType(test.format, []byte(test.stream))
+		if err != nil {
+			t.Errorf("UnmarshalByType %s err: %v", test.format, err)
+			continue
+		}
+		if result := MarshallJSON(m); result != test.expected {
+			t.Errorf("UnmarshalByType %s failed: %s != %s", test.format, result, test.expected)
+		}
+	}
+
+	for file, format := range map[string]string{"a.toml": "toml", "a.tfvars": "hcl", "a.hcl": "hcl", "a.ini": "ini"} {
+		if FormatByExtension(file) != format {
+			t.Errorf("FormatByExtension(%s) != %s", file, format)
+		}
+	}
+}
+
+func TestUnmarshalYamlDocuments(t *testing.T) {
+	os.Setenv("UNICONF_TEST_ENVIRONMENT", "prod")
+	defer os.Unsetenv("UNICONF_TEST_ENVIRONMENT")
+	m, err := UnmarshalYaml([]byte(`
+defaults: &defaults
+  replicas: 1
+  tags: [a]
+app:
+  <<: *defaults
+  name: app
+---
+when: uniconf_test_environment == prod
+app:
+  replicas: 3
+  tags: [b]
+---
+when: uniconf_test_environment != 'prod' || app.replicas == 3
+app:
+  debug: true
+---
+when: "!app.debug"
+copy: *defaults
+ports:
+  80: http
+released: 2018-01-01
+answer: y
+`))
+	if err != nil {
+		t.Fatalf("UnmarshalYaml err: %v", err)
+	}
+	expected := `{"app":{"debug":true,"name":"app","replicas":3,"tags":["a","b"]},` +
+		`"defaults":{"replicas":1,"tags":["a"]}}`
+	if result := MarshallJSON(m); result != expected {
+		t.Errorf("Documents merging failed: %s != %s", result, expected)
+	}
+
+	m, err = UnmarshalYaml([]byte("ports:\n  80: http\nreleased: 2018-01-01\nreplicas: 3\nanswer: y\n"))
+	if err != nil {
+		t.Fatalf("UnmarshalYaml err: %v", err)
+	}
+	if _, ok := m["ports"].(map[string]interface{})["80"]; !ok {
+		t.Errorf("Integer key is not a string: %v", m["ports"])
+	}
+	if released, ok := m["released"].(time.Time); !ok || released.Year() != 2018 {
+		t.Errorf("Timestamp is not decoded: %#v", m["released"])
+	}
+	if m["replicas"] != 3 {
+		t.Errorf("Integer is not decoded: %#v", m["replicas"])
+	}
+	if m["answer"] != "y" {
+		t.Errorf("String is decoded as %#v", m["answer"])
+	}
+
+	if _, err := UnmarshalYaml([]byte("a: 1\n---\nwhen: a ==\n")); err == nil {
+		t.Errorf("UnmarshalYaml should fail on invalid condition")
+	}
+	if _, err := UnmarshalYaml([]byte("a: 1\n---\nwhen: uniconf_test_undefined == prod\n")); err == nil {
+		t.Errorf("UnmarshalYaml should fail on unknown identifier")
+	}
+	m, err = UnmarshalYaml([]byte("when: a ==\n"))
+	if err != nil || m["when"] != "a ==" {
+		t.Errorf("Key when of single document is not kept: %v, %v", m, err)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	vars := map[string]interface{}{"env": "prod", "debug": false, "replicas": 3}
+	lookup := func(name string) (interface{}, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+	tests := map[string]bool{
+		"env == 'prod'":           true,
+		"env != 'prod'":           false,
+		"debug":                   false,
+		"!debug && replicas == 3": true,
+		"(env == 'dev' || env == 'stage') && true": false,
+		`env == "prod" || debug`:                   true,
+	}
+	for condition, expected := range tests {
+		result, err := EvalCondition(condition, lookup)
+		if err != nil {
+			t.Errorf("EvalCondition(%s) err: %v", condition, err)
+		}
+		if result != expected {
+			t.Errorf("EvalCondition(%s) != %v", condition, expected)
+		}
+	}
+	for _, condition := range []string{"env ==", "(env", "env == 'prod", "prod == env", "missing"} {
+		if _, err := EvalCondition(condition, lookup); err == nil {
+			t.Errorf("EvalCondition(%s) should fail", condition)
+		}
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	config := map[string]interface{}{
+		"app": map[string]interface{}{
+			"name":  "demo app",
+			"port":  8080,
+			"hosts": []interface{}{"a", "b"},
+		},
+		"quote": "it's \"$HOME\"",
+		"empty": nil,
+	}
+	tests := []struct {
+		format   string
+		options  EncodeOptions
+		expected string
+	}{
+		{"dotenv", EncodeOptions{}, "APP_HOSTS_0=a\nAPP_HOSTS_1=b\nAPP_NAME=\"demo app\"\nAPP_PORT=8080\nEMPTY=\nQUOTE=\"it's \\\"\\$HOME\\\"\"\n"},
+		{"shell", EncodeOptions{Prefix: "ci_"}, "export CI_APP_HOSTS_0='a'\nexport CI_APP_HOSTS_1='b'\nexport CI_APP_NAME='demo app'\nexport CI_APP_PORT='8080'\nexport CI_EMPTY=''\nexport CI_QUOTE='it'\\''s \"$HOME\"'\n"},
+		{"properties", EncodeOptions{}, "app.hosts.0=a\napp.hosts.1=b\napp.name=demo app\napp.port=8080\nempty=\nquote=it's \"$HOME\"\n"},
+		{"dotenv", EncodeOptions{Separator: "__", KeyCase: KeyCaseLower}, "app__hosts__0=a\n"},
+		{"json", EncodeOptions{}, `{"app":{"hosts":["a","b"],"name":"demo app","port":8080},"empty":null,"quote":"it's \"$HOME\""}`},
+		{"toml", EncodeOptions{}, "quote = \"it's \\\"$HOME\\\"\"\n"},
+		{"hcl", EncodeOptions{}, "app = {\n  hosts = [\"a\", \"b\"]\n  name  = \"demo app\"\n  port  = 8080\n}\nempty = null\n"},
+	}
+	for _, test := range tests {
+		stream, err := Encode(test.format, config, test.options)
+		if err != nil {
+			t.Errorf("Encode(%s) err: %v", test.format, err)
+		}
+		if !strings.Contains(string(stream), test.expected) {
+			t.Errorf("Encode(%s) result:\n%s\ndoesn't contain:\n%s", test.format, stream, test.expected)
+		}
+	}
+
+	if _, err := Encode("xml", config, EncodeOptions{}); err == nil {
+		t.Errorf("Encode should fail on unknown format")
+	}
+	if _, err := Encode("dotenv", config, EncodeOptions{KeyCase: "camel"}); err == nil {
+		t.Errorf("Encode should fail on unknown key case")
+	}
+	if _, err := Encode("toml", map[string]interface{}{"mixed": []interface{}{"a", 1}}, EncodeOptions{}); err == nil {
+		t.Errorf("Encode should fail on TOML mixed list")
+	}
+	if _, err := Encode("hcl", map[string]interface{}{"a-b c": 1}, EncodeOptions{}); err == nil {
+		t.Errorf("Encode should fail on invalid HCL identifier")
+	}
+	large := map[string]interface{}{"n": float64(10000000), "ratio": 0.25}
+	for format, expected := range map[string]string{"dotenv": "N=10000000\nRATIO=0.25\n", "properties": "n=10000000\nratio=0.25\n"} {
+		if stream, err := Encode(format, large, EncodeOptions{}); err != nil || string(stream) != expected {
+			t.Errorf("Encode(%s) of large number: %s, %v", format, stream, err)
+		}
+	}
+	for _, format := range []string{"dotenv", "shell"} {
+		colliding := map[string]interface{}{"a": map[string]interface{}{"b": 1}, "a-b": 2}
+		if _, err := Encode(format, colliding, EncodeOptions{}); err == nil || !strings.Contains(err.Error(), "are both encoded as A_B") {
+			t.Errorf("Encode(%s) should fail on colliding keys, err: %v", format, err)
+		}
+		stream, err := Encode(format, map[string]interface{}{"1st": "a"}, EncodeOptions{})
+		if err != nil || !strings.Contains(string(stream), "_1ST=") {
+			t.Errorf("Encode(%s) key starting with digit is not prefixed: %s, %v", format, stream, err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	type server struct {
+		Host    string        `uniconf:"host"`
+		Port    int           `uniconf:"port" default:"80"`
+		Timeout time.Duration `uniconf:"timeout" default:"5s"`
+	}
+	type app struct {
+		Name    string   `uniconf:"name"`
+		Debug   bool     `uniconf:"debug"`
+		Servers []server `uniconf:"servers"`
+		Primary server   `uniconf:"primary"`
+		Tags    []string
+	}
+	config := map[string]interface{}{
+		"name":  "demo",
+		"debug": "true",
+		"servers": []interface{}{
+			map[string]interface{}{"host": "a", "port": "8080", "timeout": "1m"},
+			map[string]interface{}{"host": "b"},
+		},
+		"tags": []interface{}{"x", "y"},
+	}
+	var result app
+	if err := Decode(config, &result, DecodeOptions{Strict: true}); err != nil {
+		t.Fatalf("Decode err: %v", err)
+	}
+	expected := app{
+		Name:  "demo",
+		Debug: true,
+		Servers: []server{
+			{Host: "a", Port: 8080, Timeout: time.Minute},
+			{Host: "b", Port: 80, Timeout: 5 * time.Second},
+		},
+		Primary: server{Port: 80, Timeout: 5 * time.Second},
+		Tags:    []string{"x", "y"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Decode result: %+v\nexpected: %+v", result, expected)
+	}
+
+	config["servers"].([]interface{})[1].(map[string]interface{})["hots"] = "c"
+	config["extra"] = 1
+	err := Decode(config, &app{}, DecodeOptions{Strict: true, Path: "apps.demo"})
+	if err == nil || err.Error() != "unknown keys: apps.demo.extra, apps.demo.servers[1].hots" {
+		t.Errorf("Decode strict err: %v", err)
+	}
+	if err := Decode(config, &app{}, DecodeOptions{}); err != nil {
+		t.Errorf("Decode non-strict err: %v", err)
+	}
+	if err := Decode(map[string]interface{}{"debug": "maybe"}, &app{}, DecodeOptions{}); err == nil {
+		t.Errorf("Decode should fail on invalid bool")
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"image"},
+		"properties": map[string]interface{}{
+			"image":   map[string]interface{}{"type": "string"},
+			"timeout": map[string]interface{}{"type": "integer"},
+		},
+	}
+	config := map[string]interface{}{
+		"jobs": map[string]interface{}{
+			"build":   map[string]interface{}{"image": "golang", "timeout": 10},
+			"install": map[string]interface{}{"timeout": "10"},
+		},
+	}
+	values := SelectPaths(config, "jobs.*")
+	if len(values) != 2 || values["jobs.build"] == nil || values["jobs.install"] == nil {
+		t.Fatalf("SelectPaths result: %v", values)
+	}
+	errors, err := ValidateSchema(values["jobs.build"], "jobs.build", schema)
+	if err != nil || len(errors) != 0 {
+		t.Errorf("ValidateSchema result: %v, err: %v", errors, err)
+	}
+	errors, err = ValidateSchema(values["jobs.install"], "jobs.install", schema)
+	if err != nil {
+		t.Fatalf("ValidateSchema err: %v", err)
+	}
+	paths := make(map[string]bool)
+	for _, e := range errors {
+		paths[e.Path] = true
+	}
+	if len(errors) != 2 || !paths["jobs.install.image"] || !paths["jobs.install.timeout"] {
+		t.Errorf("ValidateSchema errors: %v", errors)
+	}
+	if _, err := ValidateSchema(config, "", 1); err == nil {
+		t.Errorf("ValidateSchema should fail on invalid schema")
+	}
+}
+
+func TestDecryptSops(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := encryptSopsTest(t, identity.Recipient(), map[string]interface{}{
+		"db": map[string]interface{}{
+			"password": "s3cret",
+			"port":     5432,
+			"hosts":    []interface{}{"a", "b"},
+		},
+		"debug_unencrypted": "true",
+	})
+	result, err := DecryptSops(stream, []age.Identity{identity})
+	if err != nil {
+		t.Fatalf("DecryptSops err: %v", err)
+	}
+	expected := map[string]interface{}{
+		"db": map[string]interface{}{
+			"password": "s3cret",
+			"port":     5432,
+			"hosts":    []interface{}{"a", "b"},
+		},
+		"debug_unencrypted": "true",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("DecryptSops result: %v", result)
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	if _, err := DecryptSops(stream, []age.Identity{other}); err == nil {
+		t.Errorf("DecryptSops should fail with other identity")
+	}
+	tampered := strings.Replace(string(stream), "password:", "passwd:", 1)
+	if _, err := DecryptSops([]byte(tampered), []age.Identity{identity}); err == nil {
+		t.Errorf("DecryptSops should fail on moved values")
+	}
+	tampered = strings.Replace(string(stream), `debug_unencrypted: "true"`, `debug_unencrypted: "false"`, 1)
+	if _, err := DecryptSops([]byte(tampered), []age.Identity{identity}); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("DecryptSops should fail on modified unencrypted values, err: %v", err)
+	}
+	tampered = strings.Replace(string(stream), "  - ENC", "  # - ENC", 1)
+	if _, err := DecryptSops([]byte(tampered), []age.Identity{identity}); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("DecryptSops should fail on removed values, err: %v", err)
+	}
+	tampered = regexp.MustCompile(`mac: ENC\[.*\]`).ReplaceAllString(string(stream), `mac: garbage`)
+	if _, err := DecryptSops([]byte(tampered), []age.Identity{identity}); err == nil || !strings.Contains(err.Error(), "invalid encrypted value") {
+		t.Errorf("DecryptSops should fail on invalid MAC, err: %v", err)
+	}
+}
+
+// TestDecryptSopsFixtures decrypts documents encrypted by the sops tool with the test age key,
+// fixtures are encrypted by the "go/sops-fixtures" make target.
+func TestDecryptSopsFixtures(t *testing.T) {
+	dir := filepath.Join("testdata", "sops")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.enc.yaml"))
+	if len(files) == 0 {
+		t.Skip("SOPS fixtures are not encrypted, run make go/sops-fixtures")
+	}
+	key, err := ioutil.ReadFile(filepath.Join(dir, "age.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		stream, _ := ioutil.ReadFile(file)
+		plain, _ := ioutil.ReadFile(strings.TrimSuffix(file, ".enc.yaml") + ".yaml")
+		expected, err := UnmarshalYaml(plain)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		result, err := DecryptSops(stream, identities)
+		if err != nil {
+			t.Errorf("%s: DecryptSops err: %v", file, err)
+		} else if !reflect.DeepEqual(result, expected) {
+			t.Errorf("%s: DecryptSops result: %v", file, result)
+		}
+		// Unencrypted values are authenticated unless only encrypted ones are.
+		tampered := strings.Replace(string(stream), "debug_unencrypted: true", "debug_unencrypted: false", 1)
+		_, err = DecryptSops([]byte(tampered), identities)
+		if strings.HasPrefix(filepath.Base(file), "mac_only") {
+			if err != nil {
+				t.Errorf("%s: DecryptSops err: %v", file, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+			t.Errorf("%s: DecryptSops should fail on modified unencrypted values, err: %v", file, err)
+		}
+	}
+}
+
+// encryptSopsTest encrypts values of the tree the way SOPS does for the age recipient,
+// the MAC is the hash of values in order of sorted keys as they are marshalled.
+func encryptSopsTest(t *testing.T, recipient age.Recipient, tree map[string]interface{}) []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	mac := sha512.New()
+	var encrypt func(value interface{}, path string) interface{}
+	encryptValue := func(value interface{}, valueType, path string) string {
+		block, _ := aes.NewCipher(key)
+		gcm, _ := cipher.NewGCMWithNonceSize(block, 32)
+		iv := make([]byte, 32)
+		rand.Read(iv)
+		sealed := gcm.Seal(nil, iv, []byte(fmt.Sprint(value)), []byte(path))
+		data, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+		return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", base64.StdEncoding.EncodeToString(data),
+			base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(tag), valueType)
+	}
+	encrypt = func(value interface{}, path string) interface{} {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			m := make(map[string]interface{}, len(v))
+			for _, k := range keys {
+				if strings.HasSuffix(k, "_unencrypted") {
+					mac.Write([]byte(fmt.Sprint(v[k])))
+					m[k] = v[k]
+				} else {
+					m[k] = encrypt(v[k], path+k+":")
+				}
+			}
+			return m
+		case []interface{}:
+			l := make([]interface{}, len(v))
+			for i, item := range v {
+				l[i] = encrypt(item, path)
+			}
+			return l
+		}
+		valueType := "str"
+		if _, ok := value.(int); ok {
+			valueType = "int"
+		}
+		mac.Write([]byte(fmt.Sprint(value)))
+		return encryptValue(value, valueType, path)
+	}
+	var enc bytes.Buffer
+	armored := armor.NewWriter(&enc)
+	w, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(key)
+	w.Close()
+	armored.Close()
+	document := encrypt(tree, "").(map[string]interface{})
+	lastModified := "2024-01-02T03:04:05Z"
+	document[SopsMetadataKey] = map[string]interface{}{
+		"age":                []interface{}{map[string]interface{}{"recipient": fmt.Sprint(recipient), "enc": enc.String()}},
+		"lastmodified":       lastModified,
+		"mac":                encryptValue(fmt.Sprintf("%X", mac.Sum(nil)), "str", lastModified),
+		"unencrypted_suffix": "_unencrypted",
+	}
+	stream, err := yaml.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestReplaceStrings(t *testing.T) {
+	config := map[string]interface{}{
+		"db":    map[string]interface{}{"password": "s3cret", "url": "postgres://app:s3cret@db"},
+		"hosts": []interface{}{"a", "s3cret"},
+		"port":  5432,
+	}
+	replaced := ReplaceStrings(config, strings.NewReplacer("s3cret", "***").Replace)
+	expected := map[string]interface{}{
+		"db":    map[string]interface{}{"password": "***", "url": "postgres://app:***@db"},
+		"hosts": []interface{}{"a", "***"},
+		"port":  5432,
+	}
+	if !reflect.DeepEqual(replaced, expected) {
+		t.Errorf("ReplaceStrings result: %v", replaced)
+	}
+	if config["db"].(map[string]interface{})["password"] != "s3cret" {
+		t.Errorf("ReplaceStrings changed the source value")
+	}
+}
+
 var yamlExample2 = []byte(`params:
   jobs:
     params:
@@ -0,0 +1,123 @@
+package unitool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// ConditionKey is the key of document conditions of multi-document streams, e.g. "when: environment == prod".
+// It is a regular key of single-document streams.
+const ConditionKey = "when"
+
+// UnmarshalYaml decodes the YAML stream, documents of the multi-document stream are merged in order as layers.
+// Documents having conditions are merged only if conditions are true, see EvalCondition.
+// Scalar values keep their YAML types, e.g. integers & timestamps, keys are strings as they are written.
+func UnmarshalYaml(stream []byte) (map[string]interface{}, error) {
+	config, _, err := decodeYaml(stream)
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalYaml error: %v", err)
+	}
+	return config, nil
+}
+
+// decodeYaml returns the merged config & nodes of documents which were merged.
+// Identifiers of document conditions are looked up in preceding merged documents & environment variables.
+func decodeYaml(stream []byte) (map[string]interface{}, []*yaml3.Node, error) {
+	documents := make([]*yaml3.Node, 0)
+	decoder := yaml3.NewDecoder(bytes.NewReader(stream))
+	for {
+		node := &yaml3.Node{}
+		if err := decoder.Decode(node); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		resolveYamlNode(node)
+		documents = append(documents, node)
+	}
+	config := make(map[string]interface{})
+	nodes := make([]*yaml3.Node, 0, len(documents))
+	for i, node := range documents {
+		document := make(map[string]interface{})
+		if err := node.Decode(&document); err != nil {
+			return nil, nil, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		if condition, ok := document[ConditionKey]; ok && len(documents) > 1 {
+			delete(document, ConditionKey)
+			active, err := EvalCondition(fmt.Sprint(condition), func(name string) (interface{}, bool) {
+				if value, ok := lookupPath(config, name); ok {
+					return value, true
+				}
+				return lookupEnv(name)
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("document %d: %v", i+1, err)
+			}
+			if !active {
+				continue
+			}
+		}
+		// The first document is used as is to keep its merge directives for following merges.
+		if len(nodes) == 0 {
+			config = document
+		} else {
+			Merge(config, document, true)
+		}
+		nodes = append(nodes, node)
+	}
+	return config, nodes, nil
+}
+
+// resolveYamlNode makes keys strings & replaces "!delete" tagged values with DeleteDirective strings.
+func resolveYamlNode(node *yaml3.Node) {
+	if node.Tag == DeleteDirective {
+		value := DeleteDirective
+		if node.Kind == yaml3.ScalarNode && node.Value != "" {
+			value += " " + node.Value
+		}
+		*node = yaml3.Node{Kind: yaml3.ScalarNode, Tag: "!!str", Value: value, Line: node.Line, Column: node.Column}
+		return
+	}
+	if node.Kind == yaml3.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Kind == yaml3.ScalarNode && key.ShortTag() != "!!merge" {
+				key.Tag = "!!str"
+			}
+		}
+	}
+	for _, child := range node.Content {
+		resolveYamlNode(child)
+	}
+}
+
+// lookupPath returns the config value by the dotted path.
+func lookupPath(config map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = config
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookupEnv returns the environment variable by the name as is or in upper case, e.g. ENVIRONMENT for environment.
+func lookupEnv(name string) (interface{}, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	name = strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	return nil, false
+}